@@ -0,0 +1,213 @@
+package arithmospora
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AnnouncementsConfig struct {
+	Token string
+}
+
+// Announcement: a free-text message pushed to every client of a source, e.g.
+// "polls extended by 1 hour". Pinned announcements are also sent to clients
+// as they connect, until they expire or are withdrawn.
+type Announcement struct {
+	ID       int64      `json:"id"`
+	Message  string     `json:"message"`
+	Severity string     `json:"severity"`
+	Pinned   bool       `json:"pinned"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+var announcementSeverities = []string{"info", "warning", "critical"}
+
+func (a *Announcement) Validate() error {
+	if strings.TrimSpace(a.Message) == "" {
+		return fmt.Errorf("announcement message is empty")
+	}
+	if a.Severity == "" {
+		a.Severity = "info"
+	}
+	for _, severity := range announcementSeverities {
+		if a.Severity == severity {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid announcement severity %q: must be one of %s", a.Severity, strings.Join(announcementSeverities, ", "))
+}
+
+func (a *Announcement) Expired(when time.Time) bool {
+	return a.Expires != nil && !when.Before(*a.Expires)
+}
+
+type announcementList struct {
+	sync.Mutex
+	lastID int64
+	pinned []*Announcement
+}
+
+// Announce validates and broadcasts an announcement to all clients of the
+// source, retaining it for newly connecting clients if pinned
+func (s *Source) Announce(hub *Hub, announcement *Announcement) error {
+	if err := announcement.Validate(); err != nil {
+		return err
+	}
+
+	s.announcements.Lock()
+	s.announcements.lastID++
+	announcement.ID = s.announcements.lastID
+	announcement.Created = clockOrSystem(s.Clock).Now()
+	if announcement.Expired(announcement.Created) {
+		s.announcements.Unlock()
+		return fmt.Errorf("announcement expires in the past")
+	}
+	if announcement.Pinned {
+		s.announcements.pinned = append(s.announcements.pinned, announcement)
+	}
+	s.announcements.Unlock()
+
+	message, err := json.Marshal(Message{Event: "announcement", Payload: announcement})
+	if err != nil {
+		return err
+	}
+	if !hub.broadcast(message) {
+		return fmt.Errorf("source %s is no longer being served", s.Name)
+	}
+	return nil
+}
+
+// Withdraw removes a pinned announcement so that it is no longer sent to
+// newly connecting clients. Clients already showing it are sent an
+// announcement:withdrawn event
+func (s *Source) Withdraw(hub *Hub, id int64) error {
+	s.announcements.Lock()
+	found := false
+	for i, announcement := range s.announcements.pinned {
+		if announcement.ID == id {
+			s.announcements.pinned = append(s.announcements.pinned[:i], s.announcements.pinned[i+1:]...)
+			found = true
+			break
+		}
+	}
+	s.announcements.Unlock()
+	if !found {
+		return fmt.Errorf("no pinned announcement with id %v", id)
+	}
+
+	message, err := json.Marshal(Message{Event: "announcement:withdrawn", Payload: map[string]int64{"id": id}})
+	if err != nil {
+		return err
+	}
+	if !hub.broadcast(message) {
+		return fmt.Errorf("source %s is no longer being served", s.Name)
+	}
+	return nil
+}
+
+// PinnedAnnouncements returns the pinned announcements which have not yet
+// expired, discarding any which have
+func (s *Source) PinnedAnnouncements() []*Announcement {
+	s.announcements.Lock()
+	defer s.announcements.Unlock()
+	now := clockOrSystem(s.Clock).Now()
+	current := s.announcements.pinned[:0]
+	for _, announcement := range s.announcements.pinned {
+		if !announcement.Expired(now) {
+			current = append(current, announcement)
+		}
+	}
+	s.announcements.pinned = current
+	return append([]*Announcement(nil), current...)
+}
+
+// relayAnnouncement retains a pinned announcement relayed from a cluster
+// leader, replacing any with the same ID
+func (s *Source) relayAnnouncement(announcement *Announcement) {
+	s.announcements.Lock()
+	defer s.announcements.Unlock()
+	for i, pinned := range s.announcements.pinned {
+		if pinned.ID == announcement.ID {
+			s.announcements.pinned[i] = announcement
+			return
+		}
+	}
+	s.announcements.pinned = append(s.announcements.pinned, announcement)
+}
+
+// relayWithdrawal removes a pinned announcement withdrawn by a cluster leader
+func (s *Source) relayWithdrawal(id int64) {
+	s.announcements.Lock()
+	defer s.announcements.Unlock()
+	for i, announcement := range s.announcements.pinned {
+		if announcement.ID == id {
+			s.announcements.pinned = append(s.announcements.pinned[:i], s.announcements.pinned[i+1:]...)
+			return
+		}
+	}
+}
+
+// clearPinned removes every pinned announcement, returning their IDs
+func (s *Source) clearPinned() map[int64]bool {
+	s.announcements.Lock()
+	defer s.announcements.Unlock()
+	ids := make(map[int64]bool, len(s.announcements.pinned))
+	for _, announcement := range s.announcements.pinned {
+		ids[announcement.ID] = true
+	}
+	s.announcements.pinned = nil
+	return ids
+}
+
+// ServeAnnounce handles announcement requests for a source. Requests must
+// carry the configured token as a bearer token. POST creates an announcement
+// from a JSON encoded Announcement body; DELETE withdraws the pinned
+// announcement given by the id query parameter.
+func ServeAnnounce(source *Source, hub *Hub, w http.ResponseWriter, r *http.Request, token string) {
+	if token == "" {
+		http.Error(w, "announcements disabled", http.StatusNotFound)
+		return
+	}
+	provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		var announcement Announcement
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&announcement); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := source.Announce(hub, &announcement); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(announcement)
+	case http.MethodDelete:
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		if err := source.Withdraw(hub, id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,192 @@
+package arithmospora
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/naoina/toml"
+)
+
+// ArchiveVersion is the version of the archive format written by Export.
+// Archives of later versions are rejected; those of earlier versions are
+// read for as long as the format remains compatible
+const ArchiveVersion = 1
+
+// Archive holds the full state of a source at a point in time: its stat
+// tree including datapoints and timed buckets, as a Snapshot, and the states
+// of its milestones by collection
+type Archive struct {
+	Version     int                         `json:"version"`
+	Source      string                      `json:"source"`
+	RedisPrefix string                      `json:"redisPrefix"`
+	Exported    time.Time                   `json:"exported"`
+	Stats       Snapshot                    `json:"stats"`
+	Milestones  map[string][]MilestoneState `json:"milestones"`
+}
+
+// ReadArchive reads an archive from a JSON file, or a TOML file if the file
+// name ends in .toml. Plain snapshots, such as the output of aslist -f json,
+// are read as archives of version 0 holding only stats
+func ReadArchive(path string) (*Archive, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	unmarshal := json.Unmarshal
+	if strings.HasSuffix(path, ".toml") {
+		unmarshal = toml.Unmarshal
+	}
+
+	var header struct{ Version int }
+	if err := unmarshal(buf, &header); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	archive := &Archive{Version: header.Version}
+	if header.Version == 0 {
+		err = unmarshal(buf, &archive.Stats)
+	} else if header.Version > ArchiveVersion {
+		err = fmt.Errorf("archive version %v is newer than supported version %v", header.Version, ArchiveVersion)
+	} else {
+		err = unmarshal(buf, archive)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return archive, nil
+}
+
+// Export archives the source's stats and milestones. Stats must already be
+// loaded; milestones are checked against the loaded stats
+func (s *Source) Export(redisPrefix string) (*Archive, error) {
+	archive := &Archive{
+		Version:     ArchiveVersion,
+		Source:      s.Name,
+		RedisPrefix: redisPrefix,
+		Exported:    clockOrSystem(s.Clock).Now(),
+		Stats:       make(Snapshot),
+		Milestones:  make(map[string][]MilestoneState),
+	}
+
+	for statGroup, stats := range s.Stats {
+		archive.Stats[statGroup+"Stats"] = make(map[string]SnapshotStat)
+		for statKey, stat := range stats {
+			// Stats are archived as sent to clients
+			statJSON, err := json.Marshal(stat)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", statKey, err)
+			}
+			var snapshotStat SnapshotStat
+			if err := json.Unmarshal(statJSON, &snapshotStat); err != nil {
+				return nil, fmt.Errorf("%s: %v", statKey, err)
+			}
+			archive.Stats[statGroup+"Stats"][statKey] = snapshotStat
+		}
+	}
+
+	for _, mc := range s.Milestones {
+		mc.Check()
+		archive.Milestones[mc.Name] = mc.States()
+	}
+
+	return archive, nil
+}
+
+// WriteRedis writes the archived stats of the configured source to Redis
+// under the given prefix, in the layout read by the Redis loaders, using a
+// connection from pool. Existing values are overwritten; milestone states are
+// not written as milestones are not held in Redis
+func (a *Archive) WriteRedis(pool *redis.Pool, sourceConfig SourceConfig, prefix string) error {
+	conn := pool.Get()
+	defer conn.Close()
+
+	for _, statConfig := range sourceConfig.StatConfigs() {
+		snapshotStat, ok := a.Stats.Stat(statConfig.Key())
+		if !ok {
+			continue
+		}
+		keyMaker := statConfig.KeyMaker(prefix)
+		snapshotStat.Store(&RedisStatWriter{conn, statConfig.Fields, statConfig.Layout}, keyMaker.RedisPrefix, statConfig.DataType, statConfig.Fields)
+	}
+
+	// Flush and receive all pending replies
+	_, err := conn.Do("")
+	return err
+}
+
+// StatWriter sets the data of stats at their keys, as read by the loaders of
+// a data store
+type StatWriter interface {
+	SetGeneric(key string, data map[string]int)
+	SetProportion(key string, current int, total int)
+	SetRolling(key string, current int, total int, peak int)
+	SetSingleValue(key string, value int)
+	SetBucket(key string, bucket int64, values ...float64)
+	SetDataPoints(key string, dpNames ...string)
+}
+
+// RedisStatWriter pipelines the commands to write stat data to Redis: the
+// replies must be received, e.g. with Do(""). Timed buckets are written
+// according to the stat's fields and layout
+type RedisStatWriter struct {
+	Conn   redis.Conn
+	Fields []string
+	Layout string
+}
+
+func (rsw *RedisStatWriter) SetGeneric(key string, data map[string]int) {
+	if len(data) == 0 {
+		return
+	}
+	args := redis.Args{}.Add(makeKey(key, "data"))
+	for field, value := range data {
+		args = args.Add(field, value)
+	}
+	rsw.Conn.Send("HSET", args...)
+}
+
+func (rsw *RedisStatWriter) SetProportion(key string, current int, total int) {
+	rsw.Conn.Send("HSET", makeKey(key, "data"), "current", current, "total", total)
+}
+
+func (rsw *RedisStatWriter) SetRolling(key string, current int, total int, peak int) {
+	rsw.Conn.Send("HSET", makeKey(key, "data"), "current", current, "total", total, "peak", peak)
+}
+
+func (rsw *RedisStatWriter) SetSingleValue(key string, value int) {
+	rsw.Conn.Send("SET", makeKey(key, "data"), value)
+}
+
+func (rsw *RedisStatWriter) SetBucket(key string, bucket int64, values ...float64) {
+	switch {
+	case len(rsw.Fields) == 0:
+		if len(values) > 0 {
+			rsw.Conn.Send("HSET", makeKey(key, "data"), bucket, values[0])
+		}
+	case rsw.Layout == TimedLayoutJSON:
+		fields := make(map[string]float64, len(rsw.Fields))
+		for index, field := range rsw.Fields {
+			if index < len(values) {
+				fields[field] = values[index]
+			}
+		}
+		encoded, _ := json.Marshal(fields)
+		rsw.Conn.Send("HSET", makeKey(key, "data"), bucket, encoded)
+	default:
+		for index, field := range rsw.Fields {
+			if index < len(values) {
+				rsw.Conn.Send("HSET", makeKey(key, "data", field), bucket, values[index])
+			}
+		}
+	}
+}
+
+func (rsw *RedisStatWriter) SetDataPoints(key string, dpNames ...string) {
+	if len(dpNames) == 0 {
+		return
+	}
+	rsw.Conn.Send("SADD", redis.Args{}.Add(makeKey(key, "datapoints")).AddFlat(dpNames)...)
+}
@@ -0,0 +1,31 @@
+package arithmospora
+
+import "time"
+
+// Clock provides the current time and timers, allowing the passage of time
+// to be controlled in tests
+type Clock interface {
+	Now() time.Time
+	After(time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// SystemClock is the Clock used unless otherwise given, using the system time
+var SystemClock Clock = systemClock{}
+
+// clockOrSystem returns clock, or the system clock if clock is nil
+func clockOrSystem(clock Clock) Clock {
+	if clock == nil {
+		return SystemClock
+	}
+	return clock
+}
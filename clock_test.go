@@ -0,0 +1,56 @@
+package arithmospora
+
+import (
+	"sync"
+	"time"
+)
+
+// fakeClock is a Clock whose time moves only when advanced
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeClockWaiter
+}
+
+type fakeClockWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) After(d time.Duration) <-chan time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- fc.now
+		return c
+	}
+	fc.waiters = append(fc.waiters, fakeClockWaiter{fc.now.Add(d), c})
+	return c
+}
+
+// Set moves the clock to now, firing the timers due by then
+func (fc *fakeClock) Set(now time.Time) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.now = now
+	waiting := fc.waiters[:0]
+	for _, waiter := range fc.waiters {
+		if waiter.at.After(now) {
+			waiting = append(waiting, waiter)
+		} else {
+			waiter.c <- now
+		}
+	}
+	fc.waiters = waiting
+}
@@ -0,0 +1,377 @@
+package arithmospora
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cluster roles. A leader loads its sources as usual and also serves a feed
+// of everything it broadcasts; followers load nothing, relaying the leader's
+// feed to their own websocket clients
+const (
+	ClusterLeader   = "leader"
+	ClusterFollower = "follower"
+)
+
+// ClusterConfig sets the server's role in a cluster, if any. A leader serves
+// its feed on Address, and a follower connects to the leader's feed at
+// Address. If Token is set followers must present it to the leader. Leader
+// and followers must be configured with the same sources
+type ClusterConfig struct {
+	Role    string
+	Address string
+	Token   string
+}
+
+const (
+	// feedHeartbeat is how often the leader sends an empty frame to each
+	// follower when there is nothing else to send
+	feedHeartbeat = 15 * time.Second
+
+	// feedTimeout is how long either end waits to read or write a frame
+	// before giving up on the connection
+	feedTimeout = 3 * feedHeartbeat
+
+	// feedBacklog is the number of frames buffered for writing to each
+	// follower
+	feedBacklog = 64
+
+	// feedRetryMax bounds the delay between a follower's attempts to
+	// reconnect to its leader
+	feedRetryMax = 30 * time.Second
+)
+
+// FeedHello is sent by a follower on connecting to its leader's feed
+type FeedHello struct {
+	Token string `json:"token"`
+}
+
+// FeedFrame is a line of a leader's feed. Message is a message broadcast by
+// the leader, sent on to clients as is. For a stat delta, Stat holds the
+// stat in full as a stats:* message. On each connection the leader first
+// resyncs each source, sending every stat and pinned announcement as frames
+// with Resync set, the last of which also has Synced set. Frames without a
+// source are heartbeats
+type FeedFrame struct {
+	Source  string          `json:"source,omitempty"`
+	Message json.RawMessage `json:"message,omitempty"`
+	Stat    json.RawMessage `json:"stat,omitempty"`
+	Resync  bool            `json:"resync,omitempty"`
+	Synced  bool            `json:"synced,omitempty"`
+}
+
+// serveFeed accepts followers on the listener until ctx is done, serving
+// each the feed of every source
+func (s *Server) serveFeed(ctx context.Context, listener net.Listener) {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			s.report(ctx, fmt.Errorf("cluster feed: %v", err))
+			time.Sleep(time.Second)
+			continue
+		}
+		go func() {
+			if err := s.serveFollower(ctx, conn); err != nil {
+				s.report(ctx, fmt.Errorf("cluster feed to %s: %v", conn.RemoteAddr(), err))
+			}
+		}()
+	}
+}
+
+// serveFollower serves the feed to one follower until the connection fails,
+// a source's hub tap is closed, or ctx is done
+func (s *Server) serveFollower(ctx context.Context, conn net.Conn) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	var hello FeedHello
+	conn.SetReadDeadline(time.Now().Add(feedTimeout))
+	if err := json.NewDecoder(conn).Decode(&hello); err != nil {
+		return err
+	}
+	if token := s.Config.Cluster.Token; token != "" && subtle.ConstantTimeCompare([]byte(hello.Token), []byte(token)) != 1 {
+		return fmt.Errorf("invalid token")
+	}
+
+	// Tap the hubs before resyncing so nothing broadcast meanwhile is missed
+	frames := make(chan FeedFrame, feedBacklog)
+	var wg sync.WaitGroup
+	for _, source := range s.Sources {
+		tap := s.Hubs[source.Name].Tap(ctx)
+		wg.Add(1)
+		go func(source *Source) {
+			defer wg.Done()
+			defer cancel()
+			for _, frame := range source.resyncFrames() {
+				select {
+				case frames <- frame:
+				case <-ctx.Done():
+					return
+				}
+			}
+			for message := range tap {
+				frame, err := source.feedFrame(message)
+				if err != nil {
+					s.report(ctx, err)
+					continue
+				}
+				select {
+				case frames <- frame:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(source)
+	}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	writer := bufio.NewWriter(conn)
+	encoder := json.NewEncoder(writer)
+	heartbeat := time.NewTicker(feedHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		var frame FeedFrame
+		select {
+		case frame = <-frames:
+		case <-heartbeat.C:
+		case <-ctx.Done():
+			return nil
+		}
+		conn.SetWriteDeadline(time.Now().Add(feedTimeout))
+		if err := encoder.Encode(frame); err != nil {
+			return err
+		}
+		// Batch frames already waiting into one write
+		if len(frames) == 0 {
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// resyncFrames returns the frames bringing a follower up to date with the
+// source: every stat and pinned announcement
+func (s *Source) resyncFrames() (frames []FeedFrame) {
+	for statGroup, stats := range s.Stats {
+		for statKey := range stats {
+			message, err := s.statMessage("stats:" + statGroup + ":" + statKey)
+			if err != nil {
+				continue
+			}
+			frames = append(frames, FeedFrame{Source: s.Name, Message: message, Resync: true})
+		}
+	}
+	for _, announcement := range s.PinnedAnnouncements() {
+		message, err := json.Marshal(Message{Event: "announcement", Payload: announcement})
+		if err != nil {
+			continue
+		}
+		frames = append(frames, FeedFrame{Source: s.Name, Message: message, Resync: true})
+	}
+	return append(frames, FeedFrame{Source: s.Name, Resync: true, Synced: true})
+}
+
+// feedFrame returns the frame relaying a broadcast message, with the stat in
+// full for a delta
+func (s *Source) feedFrame(message []byte) (FeedFrame, error) {
+	frame := FeedFrame{Source: s.Name, Message: message}
+	envelope, err := parseEnvelope(message)
+	if err != nil {
+		return frame, fmt.Errorf("source %s: %v", s.Name, err)
+	}
+	if strings.HasPrefix(envelope.Event, "stats:") && strings.HasSuffix(envelope.Event, ":delta") {
+		if frame.Stat, err = s.statMessage(strings.TrimSuffix(envelope.Event, ":delta")); err != nil {
+			return frame, err
+		}
+	}
+	return frame, nil
+}
+
+// rawEnvelope is a Message whose payload is left encoded
+type rawEnvelope struct {
+	Version int             `json:"version"`
+	Event   string          `json:"event"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+func parseEnvelope(message []byte) (envelope rawEnvelope, err error) {
+	if err = json.Unmarshal(message, &envelope); err != nil {
+		err = fmt.Errorf("invalid message: %v", err)
+	}
+	return
+}
+
+// follow relays the leader's feed to the hubs until ctx is done,
+// reconnecting and resyncing whenever the connection is lost
+func (s *Server) follow(ctx context.Context) {
+	retry := time.Second
+	for {
+		synced, err := s.followOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		if synced {
+			retry = time.Second
+		}
+		s.report(ctx, fmt.Errorf("cluster leader %s: %v: reconnecting in %v", s.Config.Cluster.Address, err, retry))
+		select {
+		case <-time.After(retry):
+		case <-ctx.Done():
+			return
+		}
+		if retry *= 2; retry > feedRetryMax {
+			retry = feedRetryMax
+		}
+	}
+}
+
+// followOnce connects to the leader and relays its feed until the connection
+// fails, returning whether any source was resynced
+func (s *Server) followOnce(ctx context.Context) (synced bool, err error) {
+	dialer := net.Dialer{Timeout: feedTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.Config.Cluster.Address)
+	if err != nil {
+		return false, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	conn.SetWriteDeadline(time.Now().Add(feedTimeout))
+	if err := json.NewEncoder(conn).Encode(FeedHello{Token: s.Config.Cluster.Token}); err != nil {
+		return false, err
+	}
+
+	// Pinned announcements held before each source's resync, withdrawn
+	// once it completes if the leader no longer has them
+	pinnedBefore := make(map[string]map[int64]bool)
+	decoder := json.NewDecoder(bufio.NewReader(conn))
+	for {
+		var frame FeedFrame
+		conn.SetReadDeadline(time.Now().Add(feedTimeout))
+		if err := decoder.Decode(&frame); err != nil {
+			return synced, err
+		}
+		if frame.Source == "" {
+			continue
+		}
+		source, hub := s.Source(frame.Source), s.Hubs[frame.Source]
+		if source == nil || frame.Source != source.Name {
+			s.report(ctx, fmt.Errorf("cluster leader sent unknown source %s", frame.Source))
+			continue
+		}
+
+		if frame.Resync && pinnedBefore[source.Name] == nil {
+			pinnedBefore[source.Name] = source.clearPinned()
+		}
+		if frame.Synced {
+			for id := range pinnedBefore[source.Name] {
+				if message, err := json.Marshal(Message{Event: "announcement:withdrawn", Payload: map[string]int64{"id": id}}); err == nil {
+					hub.broadcast(message)
+				}
+			}
+			delete(pinnedBefore, source.Name)
+			synced = true
+			continue
+		}
+		if err := source.relayFrame(hub, frame, pinnedBefore[source.Name]); err != nil {
+			s.report(ctx, err)
+		}
+	}
+}
+
+// relayFrame applies a frame of the leader's feed to the source and
+// broadcasts its message to the hub's clients. During a resync, pinned
+// announcements already held, given by pinnedBefore, are not broadcast again
+func (s *Source) relayFrame(hub *Hub, frame FeedFrame, pinnedBefore map[int64]bool) error {
+	envelope, err := parseEnvelope(frame.Message)
+	if err != nil {
+		return fmt.Errorf("source %s: %v", s.Name, err)
+	}
+
+	switch {
+	case envelope.Event == "milestone":
+		s.IncrementMilestonesCounter()
+	case envelope.Event == "announcement":
+		var announcement Announcement
+		if err := json.Unmarshal(envelope.Payload, &announcement); err != nil {
+			return fmt.Errorf("source %s: invalid announcement: %v", s.Name, err)
+		}
+		if announcement.Pinned {
+			s.relayAnnouncement(&announcement)
+		}
+		if pinnedBefore[announcement.ID] {
+			delete(pinnedBefore, announcement.ID)
+			return nil
+		}
+	case envelope.Event == "announcement:withdrawn":
+		var withdrawn struct {
+			ID int64 `json:"id"`
+		}
+		if err := json.Unmarshal(envelope.Payload, &withdrawn); err != nil {
+			return fmt.Errorf("source %s: invalid withdrawal: %v", s.Name, err)
+		}
+		s.relayWithdrawal(withdrawn.ID)
+	case strings.HasPrefix(envelope.Event, "stats:"):
+		event, payload := envelope.Event, envelope.Payload
+		if strings.HasSuffix(event, ":delta") {
+			full, err := parseEnvelope(frame.Stat)
+			if err != nil {
+				return fmt.Errorf("source %s: %s: %v", s.Name, event, err)
+			}
+			event, payload = full.Event, full.Payload
+		}
+		stat := s.statForEvent(event)
+		if stat == nil {
+			return fmt.Errorf("source %s: no stat for event %s: check the follower is configured as the leader", s.Name, event)
+		}
+		if err := stat.Relay(payload); err != nil {
+			return err
+		}
+		s.IncrementUpdatesCounter()
+		stat.NotifyListeners(StatEvent{Full: frame.Resync})
+	}
+
+	hub.broadcast(frame.Message)
+	return nil
+}
+
+// report sends err to the server's errors channel unless ctx is done
+func (s *Server) report(ctx context.Context, err error) {
+	select {
+	case s.Errors <- err:
+	case <-ctx.Done():
+	}
+}
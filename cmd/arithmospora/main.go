@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
-	"net"
-	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/coreos/go-systemd/daemon"
@@ -13,82 +15,81 @@ import (
 )
 
 var configFile = flag.String("c", "", "/path/to/configfile")
+var follow = flag.String("follow", "", "Run as a cluster follower of the leader whose feed is at this address, overriding the config's cluster section")
+var httpAddress = flag.String("http", "", "Serve by HTTP on this address, overriding the config's http and https sections, e.g. to run a follower alongside its leader")
 
 func main() {
 	// Load config
 	log.Printf("Loading config %s", *configFile)
 	flag.Parse()
-	if err := as.ParseConfig(*configFile); err != nil {
+	config, err := as.ParseConfig(*configFile)
+	if err != nil {
 		log.Fatal("ParseConfig: ", err)
 	}
+	if *follow != "" {
+		config.Cluster = as.ClusterConfig{Role: as.ClusterFollower, Address: *follow, Token: config.Cluster.Token}
+	}
+	if *httpAddress != "" {
+		config.Http = as.HttpConfig{Address: *httpAddress}
+		config.Https = as.HttpsConfig{}
+	}
 
-	// Set config for redis and websocket
-	log.Print("Setting config for Redis and WebSocket")
-	as.SetRedisConfig(as.Config.Redis)
-	as.SetWebSocketConfig(as.Config.Websocket)
-
-	// Set up sources
+	// Set up server and its sources
 	log.Print("Setting up sources")
-	sources := as.MakeSourcesFromConfig(as.Config)
+	server := as.NewServer(config)
 
 	// Set up error channel
-	errors := make(chan error)
 	go func() {
 		for {
-			err := <-errors
+			err := <-server.Errors
 			log.Println(err)
 		}
 	}()
 
-	// Set up websocket handlers per source
-	for _, s := range sources {
-		source := s
+	// Publish sources and serve
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	switch config.Cluster.Role {
+	case as.ClusterFollower:
+		log.Printf("Following cluster leader at %s", config.Cluster.Address)
+	case as.ClusterLeader:
+		log.Printf("Serving cluster feed on %s", config.Cluster.Address)
+	}
+	for _, source := range server.Sources {
+		if config.Cluster.Role == as.ClusterFollower {
+			log.Printf("Relaying source '%s'", source.Name)
+			continue
+		}
 		log.Printf("Publishing source '%s'", source.Name)
-		// Create Hub and run
-		sourceHub := as.NewHub(source)
-		go sourceHub.Run()
-		http.HandleFunc("/"+source.Name, func(w http.ResponseWriter, r *http.Request) {
-			as.ServeWs(sourceHub, w, r, errors)
-		})
-
-		// Publish source
-		if err := source.Publish(sourceHub, errors); err != nil {
-			log.Fatal("source.Publish: ", err)
+		if recordFile := config.Source(source.Name).RecordFile; recordFile != "" {
+			log.Printf("Source '%s': recording refreshes to %s", source.Name, recordFile)
 		}
+	}
+	if err := server.Start(ctx); err != nil {
+		log.Fatal("server.Start: ", err)
+	}
 
-		// Perform periodic tasks: Periodically log number of connected clients and updates count
+	// Perform periodic tasks: Periodically log number of connected clients and updates count
+	go func() {
 		tickerLog := time.NewTicker(10 * time.Second)
-		tickerRefresh := time.NewTicker(120 * time.Second)
-		go func() {
-			for {
-				select {
-				case <-tickerLog.C:
-					log.Printf("Source '%s': %v clients; %v updates; %v milestones", source.Name, sourceHub.ClientCount(), source.PopUpdatesCounter(), source.PopMilestonesCounter())
-				case <-tickerRefresh.C:
-					if source.IsLive {
-						log.Printf("Source '%s': periodic refresh", source.Name)
-						source.RefreshAll(errors)
+		defer tickerLog.Stop()
+		for {
+			select {
+			case <-tickerLog.C:
+				for _, source := range server.Sources {
+					log.Printf("Source '%s': %v clients; %v updates; %v milestones", source.Name, server.Hubs[source.Name].ClientCount(), source.PopUpdatesCounter(), source.PopMilestonesCounter())
+					for reason, count := range server.Hubs[source.Name].PopDisconnectCounts() {
+						log.Printf("Source '%s': %v clients disconnected: %s", source.Name, count, reason)
+					}
+					for _, slow := range source.SlowListeners(10 * time.Second) {
+						log.Printf("Source '%s': slow listener %s: event pending %v; %v coalesced; max lag %v", source.Name, slow.Name, slow.PendingFor, slow.Coalesced, slow.MaxLag)
 					}
 				}
+			case <-ctx.Done():
+				return
 			}
-		}()
-	}
-
-	// Determine server address
-	address := ""
-	if as.Config.Https.Address != "" {
-		address = as.Config.Https.Address
-	} else if as.Config.Http.Address != "" {
-		address = as.Config.Http.Address
-	} else {
-		log.Fatal("Missing adress in configuration http or https section")
-	}
-
-	// Open socket
-	listener, err := net.Listen("tcp", address)
-	if err != nil {
-		log.Fatal("Cannot open listener: ", err)
-	}
+		}
+	}()
 
 	// Notify systemd ready
 	daemon.SdNotify(false, daemon.SdNotifyReady)
@@ -107,11 +108,19 @@ func main() {
 		}
 	}()
 
-	// Launch server
-	https := as.Config.Https
-	if https.Cert != "" && https.Key != "" {
-		log.Fatal(http.ServeTLS(listener, nil, https.Cert, https.Key))
-	} else {
-		log.Fatal(http.Serve(listener, nil))
+	// Serve until stopped by a signal, then shut down gracefully
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-server.Stopped():
+		log.Fatal(err)
+	case sig := <-signals:
+		log.Printf("Received %v: shutting down", sig)
+		daemon.SdNotify(false, daemon.SdNotifyStopping)
+	}
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Println("server.Shutdown: ", err)
 	}
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	as "github.com/icunion/arithmospora"
+)
+
+var configFile = flag.String("c", "", "/path/to/configfile")
+var sourceName = flag.String("source", "", "Name of source to announce to. Defaults to first source in config file")
+var serverURL = flag.String("url", "", "Base URL of the server, e.g. https://server.hostname:8443. Defaults to the address in the config file")
+var message = flag.String("m", "", "Announcement message")
+var severity = flag.String("severity", "info", "Announcement severity: info, warning or critical")
+var expires = flag.Duration("expires", 0, "Expire the announcement after this duration, e.g. 2h. Zero for no expiry")
+var pinned = flag.Bool("pinned", false, "Pin the announcement so it is also sent to newly connecting clients")
+var withdraw = flag.Int64("withdraw", 0, "Withdraw the pinned announcement with this id instead of announcing")
+var insecure = flag.Bool("insecure", false, "Skip TLS certificate verification")
+
+func main() {
+	// Load config
+	flag.Parse()
+	config, err := as.ParseConfig(*configFile)
+	if err != nil {
+		fail(err)
+	}
+	if config.Announcements.Token == "" {
+		fail(fmt.Errorf("announcements token not set in config"))
+	}
+	if *sourceName == "" {
+		if len(config.Sources) == 0 {
+			fail(fmt.Errorf("no sources in config"))
+		}
+		*sourceName = config.Sources[0].Name
+	}
+
+	// Determine endpoint
+	if *serverURL == "" {
+		if config.Https.Address != "" {
+			*serverURL = "https://" + config.Https.Address
+		} else if config.Http.Address != "" {
+			*serverURL = "http://" + config.Http.Address
+		} else {
+			fail(fmt.Errorf("missing address in configuration http or https section"))
+		}
+	}
+	endpoint := *serverURL + "/" + *sourceName + "/announce"
+
+	// Build request
+	var req *http.Request
+	if *withdraw != 0 {
+		req, err = http.NewRequest(http.MethodDelete, fmt.Sprintf("%s?id=%v", endpoint, *withdraw), nil)
+	} else {
+		announcement := as.Announcement{Message: *message, Severity: *severity, Pinned: *pinned}
+		if *expires > 0 {
+			expiry := time.Now().Add(*expires)
+			announcement.Expires = &expiry
+		}
+		if err := announcement.Validate(); err != nil {
+			fail(err)
+		}
+		body, err := json.Marshal(announcement)
+		if err != nil {
+			fail(err)
+		}
+		req, err = http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+	}
+	if err != nil {
+		fail(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+config.Announcements.Token)
+
+	// Send request and print response
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: *insecure}},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		fail(err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		fail(fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(respBody)))
+	}
+	fmt.Printf("%s %s\n", resp.Status, bytes.TrimSpace(respBody))
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
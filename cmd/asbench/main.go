@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/websocket"
+
+	as "github.com/icunion/arithmospora"
+)
+
+var configFile = flag.String("c", "", "/path/to/configfile")
+var sourceToBench = flag.String("source", "", "Name of source to benchmark. Defaults to first source in config file")
+var serverURL = flag.String("url", "", "Websocket URL of a running server's source, e.g. ws://localhost:8080/election. Updates are then driven into Redis. Defaults to serving the source in-process")
+var loaderType = flag.String("loader", "memory", "Loader type of the in-process server's stats: memory, or redis to drive updates into Redis")
+var clientCount = flag.Int("clients", 100, "Number of websocket clients to open")
+var rate = flag.Float64("rate", 10, "Synthetic updates per second, spread across the source's stats")
+var duration = flag.Duration("duration", 30*time.Second, "How long to drive updates for")
+var timeout = flag.Duration("timeout", 30*time.Second, "How long to wait for clients to connect and receive initial data")
+var shards = flag.String("shards", "", "Comma separated shard counts of the in-process server's hub, e.g. 1,2,4,8, to compare how fan-out latency scales. The benchmark is run once per count. Defaults to the configured count")
+
+func main() {
+	// Load config
+	flag.Parse()
+	config, err := as.ParseConfig(*configFile)
+	if err != nil {
+		log.Fatal("ParseConfig: ", err)
+	}
+	sourceConfig := config.Source(*sourceToBench)
+	if sourceConfig == nil {
+		log.Fatalf("Source %s not found", *sourceToBench)
+	}
+	shardCounts, err := parseShards(*shards)
+	if err != nil {
+		log.Fatal("Invalid -shards: ", err)
+	}
+	if *serverURL != "" && *shards != "" {
+		log.Fatal("-shards applies only to the in-process server, not with -url")
+	}
+	pool := config.Redis.NewPool()
+	defer pool.Close()
+
+	if *serverURL != "" {
+		if !bench(*serverURL, newDriver(*sourceConfig, nil, pool)) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Serve the source in-process, once per shard count
+	*sourceConfig = sourceConfig.WithLoaderType(*loaderType)
+	sourceConfig.IsLive = true
+	sourceConfig.RecordFile = ""
+	ok := true
+	for _, shardCount := range shardCounts {
+		benchConfig := *config
+		if shardCount > 0 {
+			benchConfig.Websocket.Shards = shardCount
+			fmt.Printf("Shards:       %v\n", shardCount)
+		}
+		server, err := serve(benchConfig, *sourceConfig)
+		if err != nil {
+			log.Fatal("Cannot serve source: ", err)
+		}
+		url := "ws://" + server.Addr().String() + "/" + sourceConfig.Name
+		ok = bench(url, newDriver(*sourceConfig, server.Sources[0].MemoryStore, pool)) && ok
+		server.Shutdown(context.Background())
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// parseShards parses the -shards list, returning a single zero count, for
+// the configured number of shards, if it is empty
+func parseShards(list string) ([]int, error) {
+	if list == "" {
+		return []int{0}, nil
+	}
+	var counts []int
+	for _, field := range strings.Split(list, ",") {
+		count, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || count < 1 {
+			return nil, fmt.Errorf("%q is not a positive shard count", field)
+		}
+		counts = append(counts, count)
+	}
+	return counts, nil
+}
+
+// bench connects clients to the url, drives updates and reports, returning
+// false if any client failed
+func bench(url string, d *driver) bool {
+	// Connect clients and wait for their initial data
+	log.Printf("Connecting %v clients to %s", *clientCount, url)
+	clients := make([]*client, *clientCount)
+	var wg sync.WaitGroup
+	for i := range clients {
+		clients[i] = &client{driver: d, ready: make(chan struct{})}
+		wg.Add(1)
+		go func(c *client) {
+			defer wg.Done()
+			c.run(url)
+		}(clients[i])
+	}
+	deadline := time.After(*timeout)
+	for _, c := range clients {
+		select {
+		case <-c.ready:
+		case <-deadline:
+		}
+	}
+
+	// Drive updates, then allow the last to fan out
+	log.Printf("Driving %v updates per second for %v", *rate, *duration)
+	d.run(*rate, *duration)
+	time.Sleep(2 * time.Second)
+	for _, c := range clients {
+		c.close()
+	}
+	wg.Wait()
+
+	return report(clients, d)
+}
+
+// serve serves only the given source over http on a localhost port
+func serve(config as.Config, sourceConfig as.SourceConfig) (*as.Server, error) {
+	config.Sources = []as.SourceConfig{sourceConfig}
+	config.Http = as.HttpConfig{Address: "127.0.0.1:0"}
+	config.Https = as.HttpsConfig{}
+	server := as.NewServer(&config)
+	go func() {
+		for {
+			err := <-server.Errors
+			log.Println(err)
+		}
+	}()
+	if err := server.Start(context.Background()); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// driver writes synthetic updates into the source's stats, in the memory
+// store of an in-process source or otherwise Redis. Each update sets a
+// marker value, the update number, so that clients can match the updates
+// they receive to when they were sent
+type driver struct {
+	sourceConfig as.SourceConfig
+	store        *as.MemoryStore
+	pool         *redis.Pool
+	stats        []benchStat
+	mu           sync.Mutex
+	markers      map[string]marker
+	sent         map[string]map[int]time.Time
+	updates      int
+}
+
+// benchStat is a stat config with the event under which the stat is
+// published in its group
+type benchStat struct {
+	as.StatConfig
+	event string
+}
+
+// marker locates the marker value in a stat's messages: the named field of
+// its data or, for timed stats, the latest bucket of the named data point,
+// of its field if it has fields
+type marker struct {
+	field     string
+	dataPoint string
+}
+
+func newDriver(sourceConfig as.SourceConfig, store *as.MemoryStore, pool *redis.Pool) *driver {
+	d := &driver{
+		sourceConfig: sourceConfig,
+		store:        store,
+		pool:         pool,
+		markers:      make(map[string]marker),
+		sent:         make(map[string]map[int]time.Time),
+	}
+	periods, _ := sourceConfig.Periods()
+	finest := as.FinestPeriod(periods)
+	for group, statConfigs := range sourceConfig.GroupedStatConfigs() {
+		for _, statConfig := range statConfigs {
+			event := "stats:" + group + ":" + statConfig.Key()
+			switch statConfig.DataType {
+			case "proportion", "rolling":
+				d.markers[event] = marker{field: "current"}
+			case "single_value":
+				d.markers[event] = marker{field: statConfig.Name}
+			case "generic":
+				d.markers[event] = marker{field: "bench"}
+			case "timed":
+				if finest != nil {
+					d.markers[event] = marker{dataPoint: finest.DataPointName()}
+					if len(statConfig.Fields) > 0 {
+						d.markers[event] = marker{field: statConfig.Fields[0], dataPoint: finest.DataPointName()}
+					}
+				}
+			}
+			d.stats = append(d.stats, benchStat{statConfig, event})
+			d.sent[event] = make(map[int]time.Time)
+		}
+	}
+	sort.Slice(d.stats, func(i, j int) bool { return d.stats[i].event < d.stats[j].event })
+	return d
+}
+
+func (d *driver) run(rate float64, duration time.Duration) {
+	if len(d.stats) == 0 || rate <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+	stop := time.After(duration)
+	for n := 1; ; n++ {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := d.update(d.stats[(n-1)%len(d.stats)], n); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+func (d *driver) update(stat benchStat, n int) error {
+	statConfig, event := stat.StatConfig, stat.event
+	key := statConfig.KeyMaker(d.sourceConfig.RedisPrefix).RedisPrefix
+
+	var (
+		writer as.StatWriter
+		conn   redis.Conn
+	)
+	if d.store != nil {
+		writer = d.store
+	} else {
+		conn = d.pool.Get()
+		defer conn.Close()
+		writer = &as.RedisStatWriter{Conn: conn, Fields: statConfig.Fields, Layout: statConfig.Layout}
+	}
+
+	switch statConfig.DataType {
+	case "proportion":
+		writer.SetProportion(key, n, 2*n)
+	case "rolling":
+		writer.SetRolling(key, n, 2*n, n)
+	case "single_value":
+		writer.SetSingleValue(key, n)
+	case "generic":
+		writer.SetGeneric(key, map[string]int{"bench": n})
+	case "timed":
+		periods, _ := d.sourceConfig.Periods()
+		if finest := as.FinestPeriod(periods); finest != nil {
+			values := make([]float64, len(statConfig.Fields)+1)
+			for i := range values {
+				values[i] = float64(n)
+			}
+			writer.SetBucket(as.RedisMakeKey(key, "datapoints", finest.DataPointName()), finest.BucketFor(time.Now()), values...)
+		}
+	}
+
+	d.mu.Lock()
+	d.sent[event][n] = time.Now()
+	d.updates++
+	d.mu.Unlock()
+
+	if d.store != nil {
+		d.store.Update(key)
+		return nil
+	}
+	_, err := conn.Do("PUBLISH", as.RedisMakeKey(key, "updates"), n)
+	return err
+}
+
+// latency returns how long after it was sent the update given in a message
+// was received, if the message is of a stat carrying a marker
+func (d *driver) latency(event string, payload json.RawMessage, received time.Time) (time.Duration, bool) {
+	event = strings.TrimSuffix(event, ":delta")
+	marker, ok := d.markers[event]
+	if !ok {
+		return 0, false
+	}
+	n, ok := marker.value(payload)
+	if !ok {
+		return 0, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sent, ok := d.sent[event][int(n)]
+	if !ok {
+		return 0, false
+	}
+	return received.Sub(sent), true
+}
+
+// value returns the marker value in a stat message's payload. Timed stats
+// are sent whole or as deltas of the buckets which have changed, so the
+// latest marker is the greatest value sent
+func (m marker) value(payload json.RawMessage) (float64, bool) {
+	if m.dataPoint == "" {
+		var stat struct {
+			Data map[string]float64
+		}
+		if err := json.Unmarshal(payload, &stat); err != nil {
+			return 0, false
+		}
+		n, ok := stat.Data[m.field]
+		return n, ok
+	}
+
+	var stat struct {
+		DataPoints map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(payload, &stat); err != nil {
+		return 0, false
+	}
+	var values []float64
+	if m.field == "" {
+		var buckets map[string]float64
+		if err := json.Unmarshal(stat.DataPoints[m.dataPoint], &buckets); err != nil {
+			return 0, false
+		}
+		for _, value := range buckets {
+			values = append(values, value)
+		}
+	} else {
+		var columns struct {
+			Series map[string][]float64
+		}
+		if err := json.Unmarshal(stat.DataPoints[m.dataPoint], &columns); err != nil {
+			return 0, false
+		}
+		values = columns.Series[m.field]
+	}
+	if len(values) == 0 {
+		return 0, false
+	}
+	n := values[0]
+	for _, value := range values[1:] {
+		if value > n {
+			n = value
+		}
+	}
+	return n, true
+}
+
+type client struct {
+	driver      *driver
+	conn        *websocket.Conn
+	mu          sync.Mutex
+	ready       chan struct{}
+	readyOnce   sync.Once
+	err         error
+	connect     time.Duration
+	available   time.Duration
+	initialData time.Duration
+	latencies   []time.Duration
+}
+
+func (c *client) run(url string) {
+	defer c.readyOnce.Do(func() { close(c.ready) })
+	start := time.Now()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		c.err = err
+		return
+	}
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+	c.connect = time.Since(start)
+
+	expected := -1
+	initial := make(map[string]bool)
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		received := time.Now()
+		var message struct {
+			Event   string
+			Payload json.RawMessage
+		}
+		if err := json.Unmarshal(data, &message); err != nil {
+			continue
+		}
+
+		switch {
+		case message.Event == "available":
+			c.available = received.Sub(start)
+			var available map[string][]string
+			json.Unmarshal(message.Payload, &available)
+			expected = 0
+			for _, statKeys := range available {
+				expected += len(statKeys)
+			}
+			if err := conn.WriteJSON(as.Message{Version: as.ProtocolVersion, Event: "ready"}); err != nil {
+				return
+			}
+		case strings.HasPrefix(message.Event, "stats:") && c.initialData == 0:
+			initial[message.Event] = true
+			if len(initial) == expected {
+				c.initialData = received.Sub(start)
+				c.readyOnce.Do(func() { close(c.ready) })
+			}
+		case strings.HasPrefix(message.Event, "stats:"):
+			if latency, ok := c.driver.latency(message.Event, message.Payload, received); ok {
+				c.latencies = append(c.latencies, latency)
+			}
+		}
+	}
+}
+
+func (c *client) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// report prints the benchmark's results, returning false if any client failed
+func report(clients []*client, d *driver) bool {
+	var connect, available, initialData, latencies []time.Duration
+	failed := 0
+	for _, c := range clients {
+		if c.err != nil {
+			failed++
+			continue
+		}
+		connect = append(connect, c.connect)
+		if c.available > 0 {
+			available = append(available, c.available)
+		}
+		if c.initialData > 0 {
+			initialData = append(initialData, c.initialData)
+		}
+		latencies = append(latencies, c.latencies...)
+	}
+
+	fmt.Printf("Clients:      %v connected, %v failed\n", len(clients)-failed, failed)
+	fmt.Printf("Connect:      %s\n", percentiles(connect))
+	fmt.Printf("Available:    %s\n", percentiles(available))
+	fmt.Printf("Initial data: %s\n", percentiles(initialData))
+	fmt.Printf("Updates:      %v driven, %v received\n", d.updates, len(latencies))
+	fmt.Printf("Fan-out:      %s\n", percentiles(latencies))
+	return failed == 0
+}
+
+func percentiles(durations []time.Duration) string {
+	if len(durations) == 0 {
+		return "no samples"
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	at := func(p float64) time.Duration {
+		return durations[int(p*float64(len(durations)-1))]
+	}
+	return fmt.Sprintf("n=%v p50=%v p90=%v p99=%v max=%v", len(durations), at(0.5), at(0.9), at(0.99), durations[len(durations)-1])
+}
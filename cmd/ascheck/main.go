@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	as "github.com/icunion/arithmospora"
+)
+
+var configFile = flag.String("c", "", "/path/to/configfile")
+var checkRedis = flag.Bool("redis", false, "Also check that the Redis keys read by stats exist and have the expected types")
+
+func main() {
+	flag.Parse()
+	os.Exit(check())
+}
+
+// check checks the config, returning the exit status. Exiting is left to
+// main so that deferred cleanup, such as closing the Redis pool, runs first
+func check() int {
+	// Load and validate config
+	config, err := as.ParseConfig(*configFile)
+	if err != nil {
+		return report(err)
+	}
+
+	// Check Redis keys
+	if *checkRedis {
+		pool := config.Redis.NewPool()
+		defer pool.Close()
+		problems, err := as.CheckRedisKeys(config, pool)
+		if err != nil {
+			return report(err)
+		}
+		if len(problems) > 0 {
+			return report(problems)
+		}
+	}
+
+	fmt.Printf("%s: OK\n", *configFile)
+	return 0
+}
+
+// report prints each problem found with the config and returns the exit
+// status for failure
+func report(err error) int {
+	if problems, ok := err.(as.ConfigProblems); ok {
+		for _, problem := range problems {
+			if problem.Line > 0 {
+				fmt.Fprintf(os.Stderr, "%s:%v: %s\n", *configFile, problem.Line, problem.Message)
+			} else {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", *configFile, problem.Message)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "%v problems found\n", len(problems))
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configFile, err)
+	}
+	return 1
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	as "github.com/icunion/arithmospora"
+)
+
+var configFile = flag.String("c", "", "/path/to/configfile")
+var sourceToExport = flag.String("source", "", "Name of source to export. Defaults to first source in config file")
+var outputFile = flag.String("o", "", "Write the archive to this file rather than stdout")
+var prettyPrint = flag.Bool("pp", false, "Pretty print json")
+
+func main() {
+	// Load config
+	flag.Parse()
+	config, err := as.ParseConfig(*configFile)
+	if err != nil {
+		fail(err)
+	}
+
+	// Load sources
+	server := as.NewServer(config)
+	defer server.Shutdown(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			select {
+			case err := <-server.Errors:
+				fmt.Fprintln(os.Stderr, err)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	sources := server.Sources
+	if len(sources) == 0 {
+		fail(fmt.Errorf("no sources in config"))
+	}
+	if *sourceToExport == "" {
+		*sourceToExport = sources[0].Name
+	}
+
+	for i, source := range sources {
+		if source.Name != *sourceToExport {
+			continue
+		}
+
+		// Load stat data and archive
+		if err := source.FollowUpstream(ctx, server.Errors); err != nil {
+			fail(err)
+		}
+		for _, stats := range source.Stats {
+			for _, stat := range stats {
+				if err := stat.Reload(); err != nil {
+					fail(err)
+				}
+			}
+		}
+		archive, err := source.Export(config.Sources[i].RedisPrefix)
+		if err != nil {
+			fail(err)
+		}
+
+		var archiveJSON []byte
+		if *prettyPrint {
+			archiveJSON, err = json.MarshalIndent(archive, "", "    ")
+		} else {
+			archiveJSON, err = json.Marshal(archive)
+		}
+		if err != nil {
+			fail(err)
+		}
+		if *outputFile != "" {
+			err = ioutil.WriteFile(*outputFile, append(archiveJSON, '\n'), 0644)
+		} else {
+			_, err = fmt.Printf("%s\n", archiveJSON)
+		}
+		if err != nil {
+			fail(err)
+		}
+		return
+	}
+	fail(fmt.Errorf("source %s not found", *sourceToExport))
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	as "github.com/icunion/arithmospora"
+)
+
+var configFile = flag.String("c", "", "/path/to/configfile")
+var sourceToImport = flag.String("source", "", "Name of source in config file whose stats define the archive's layout. Defaults to the archived source, or the first source in config file")
+var archiveFile = flag.String("i", "", "Path to archive written by asexport, or snapshot written by aslist -f json")
+var redisPrefix = flag.String("prefix", "", "Redis prefix to import under. Must differ from the source's configured prefix unless -force is given")
+var force = flag.Bool("force", false, "Allow importing under the source's configured prefix, overwriting its live data")
+
+func main() {
+	// Load config
+	flag.Parse()
+	config, err := as.ParseConfig(*configFile)
+	if err != nil {
+		fail(err)
+	}
+	if *archiveFile == "" {
+		fail(fmt.Errorf("archive file not specified"))
+	}
+	if *redisPrefix == "" {
+		fail(fmt.Errorf("redis prefix not specified"))
+	}
+
+	archive, err := as.ReadArchive(*archiveFile)
+	if err != nil {
+		fail(err)
+	}
+	if *sourceToImport == "" {
+		*sourceToImport = archive.Source
+	}
+
+	// Find the source defining the stats to import
+	sourceConfig := config.Source(*sourceToImport)
+	if sourceConfig == nil {
+		fail(fmt.Errorf("source %s not found in config", *sourceToImport))
+	}
+	if *redisPrefix == sourceConfig.RedisPrefix && !*force {
+		fail(fmt.Errorf("prefix %s is the source's configured prefix: use -force to overwrite", *redisPrefix))
+	}
+
+	// Write to Redis
+	pool := config.Redis.NewPool()
+	defer pool.Close()
+	if err := archive.WriteRedis(pool, *sourceConfig, *redisPrefix); err != nil {
+		fail(err)
+	}
+	fmt.Printf("Imported %s into %s\n", *archiveFile, *redisPrefix)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
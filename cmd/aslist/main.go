@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"os"
 
 	as "github.com/icunion/arithmospora"
 )
@@ -16,15 +18,27 @@ var prettyPrint = flag.Bool("pp", false, "Pretty print json (ignored if format i
 func main() {
 	// Load config
 	flag.Parse()
-	if err := as.ParseConfig(*configFile); err != nil {
+	config, err := as.ParseConfig(*configFile)
+	if err != nil {
 		panic(err)
 	}
 
-	// Setup redis config
-	as.SetRedisConfig(as.Config.Redis)
-
 	// Load sources
-	sources := as.MakeSourcesFromConfig(as.Config)
+	server := as.NewServer(config)
+	defer server.Shutdown(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			select {
+			case err := <-server.Errors:
+				fmt.Fprintln(os.Stderr, err)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	sources := server.Sources
 	if *sourceToWatch == "" {
 		*sourceToWatch = sources[0].Name
 	}
@@ -35,11 +49,15 @@ func main() {
 	// Load stat data and print
 	for _, source := range sources {
 		if source.Name == *sourceToWatch {
+			if err := source.FollowUpstream(ctx, server.Errors); err != nil {
+				fmt.Println(err)
+				return
+			}
 			for statGroup, stats := range source.Stats {
 				if *outputFormat == "text" {
 					fmt.Printf("Stat group: %s\n", statGroup)
 				}
-				for _, stat := range stats {
+				for statKey, stat := range stats {
 					if err := stat.Reload(); err != nil {
 						fmt.Println(err)
 						return
@@ -49,7 +67,7 @@ func main() {
 						if sourceOutput[statGroup+"Stats"] == nil {
 							sourceOutput[statGroup+"Stats"] = make(map[string]*as.Stat)
 						}
-						sourceOutput[statGroup+"Stats"][stat.Name] = stat
+						sourceOutput[statGroup+"Stats"][statKey] = stat
 					} else {
 						fmt.Println(stat)
 					}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	as "github.com/icunion/arithmospora"
+)
+
+var configFile = flag.String("c", "", "/path/to/configfile")
+var sourceToReplay = flag.String("source", "", "Name of source to replay. Defaults to first source in config file")
+var recordingFile = flag.String("i", "", "Path to recording written by a source's record_file")
+var speed = flag.Float64("speed", 1, "Replay speed as a multiple of the original pace, or 0 to step through refreshes by pressing enter")
+var address = flag.String("address", "localhost:8080", "Address to serve the replayed source's websocket on")
+
+func main() {
+	// Load config
+	flag.Parse()
+	config, err := as.ParseConfig(*configFile)
+	if err != nil {
+		log.Fatal("ParseConfig: ", err)
+	}
+
+	// Read recording
+	recording, err := os.Open(*recordingFile)
+	if err != nil {
+		log.Fatal("Cannot open recording: ", err)
+	}
+	records, err := as.ReadRecording(recording)
+	recording.Close()
+	if err != nil {
+		log.Fatal("ReadRecording: ", err)
+	}
+	if len(records) == 0 {
+		log.Fatal("Recording is empty")
+	}
+
+	// Set up the source to replay, loading its stats from memory, served
+	// only over http at the given address
+	sourceConfig := config.Source(*sourceToReplay)
+	if sourceConfig == nil {
+		log.Fatalf("Source %s not found", *sourceToReplay)
+	}
+	replayConfig := *config
+	replayConfig.Sources = []as.SourceConfig{as.ReplaySourceConfig(*sourceConfig)}
+	replayConfig.Http = as.HttpConfig{Address: *address}
+	replayConfig.Https = as.HttpsConfig{}
+	clock := as.NewReplayClock(records[0].Time)
+	server := as.NewServerWithClock(&replayConfig, clock)
+	source := server.Sources[0]
+	replayer := as.NewReplayer(source, replayConfig.Sources[0], clock, records)
+	replayer.Speed = *speed
+	if err := replayer.Preload(); err != nil {
+		log.Fatal("Preload: ", err)
+	}
+
+	// Set up error channel
+	go func() {
+		for {
+			err := <-server.Errors
+			log.Println(err)
+		}
+	}()
+
+	// Publish source and serve
+	if err := server.Start(context.Background()); err != nil {
+		log.Fatal("server.Start: ", err)
+	}
+	go func() {
+		log.Fatal(<-server.Stopped())
+	}()
+	log.Printf("Serving source '%s' at ws://%s/%s", source.Name, server.Addr(), source.Name)
+
+	// Step through refreshes on enter if not replaying at speed
+	if *speed <= 0 {
+		step := make(chan bool)
+		replayer.Step = step
+		go func() {
+			scanner := bufio.NewScanner(os.Stdin)
+			for {
+				fmt.Printf("%s: press enter for next refresh ", clock.Now().Format(time.RFC3339))
+				if !scanner.Scan() {
+					return
+				}
+				step <- true
+			}
+		}()
+	}
+
+	// Replay, then keep serving the final state until aborted
+	replayer.Replay(context.Background(), server.Errors)
+	log.Printf("Replay complete at %s", clock.Now().Format(time.RFC3339))
+	select {}
+}
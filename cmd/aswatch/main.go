@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"time"
@@ -15,15 +16,14 @@ var statToWatch = flag.String("stat", "all", "Name of stat to watch. Defaults to
 func main() {
 	// Load config
 	flag.Parse()
-	if err := as.ParseConfig(*configFile); err != nil {
+	config, err := as.ParseConfig(*configFile)
+	if err != nil {
 		panic(err)
 	}
 
-	// Setup redis config
-	as.SetRedisConfig(as.Config.Redis)
-
 	// Set up sources
-	sources := as.MakeSourcesFromConfig(as.Config)
+	server := as.NewServer(config)
+	sources := server.Sources
 	if *sourceToWatch == "" {
 		*sourceToWatch = sources[0].Name
 	}
@@ -33,7 +33,7 @@ func main() {
 			for _, stats := range source.Stats {
 				for _, stat := range stats {
 					if *statToWatch == "all" || *statToWatch == stat.Name {
-						if err := printOnUpdate(stat, as.Config.Debounce); err != nil {
+						if err := printOnUpdate(stat, source.Debounce); err != nil {
 							fmt.Println(err)
 							return
 						}
@@ -49,16 +49,17 @@ func main() {
 
 func printOnUpdate(stat *as.Stat, debounce as.DebounceConfig) error {
 	errors := make(chan error)
-	if err := stat.ListenForUpdates(time.Duration(debounce.MinTimeMs)*time.Millisecond, time.Duration(debounce.MaxTimeMs)*time.Millisecond, errors); err != nil {
+	if err := stat.ListenForUpdates(context.Background(), time.Duration(debounce.MinTimeMs)*time.Millisecond, time.Duration(debounce.MaxTimeMs)*time.Millisecond, errors); err != nil {
 		return err
 	}
+	listener := stat.Listen(context.Background(), "aswatch")
 	go func() {
-		updated := make(chan bool)
-		stat.RegisterListener(updated)
 		for {
 			select {
-			case <-updated:
-				fmt.Println(stat.String())
+			case <-listener.Ready():
+				if _, ok := listener.Next(); ok {
+					fmt.Println(stat.String())
+				}
 			case err := <-errors:
 				fmt.Println(err)
 			}
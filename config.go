@@ -5,16 +5,21 @@ import (
 	"io/ioutil"
 	"time"
 
+	"github.com/garyburd/redigo/redis"
 	"github.com/naoina/toml"
 )
 
-type tomlConfig struct {
-	Redis     RedisConfig
-	Http      HttpConfig
-	Https     HttpsConfig
-	Websocket WebsocketConfig
-	Debounce  DebounceConfig
-	Sources   []SourceConfig
+// Config is the parsed config file, from which a Server is built
+type Config struct {
+	Redis         RedisConfig
+	Http          HttpConfig
+	Https         HttpsConfig
+	Websocket     WebsocketConfig
+	Debounce      DebounceConfig
+	Announcements AnnouncementsConfig
+	Cluster       ClusterConfig
+	Sources       []SourceConfig
+	locations     configLocations
 }
 
 type HttpConfig struct {
@@ -38,9 +43,19 @@ type SourceConfig struct {
 	StartTime        time.Time
 	EndTime          time.Time
 	IsLive           bool
+	UpdateMode       string
+	PollIntervalMs   int
+	TimedDeltas      bool
+	EndGrace         *int64
+	WholePeriodTail  *int64
+	Timezone         string
+	SnapshotFile     string
+	UpstreamURL      string
+	RecordFile       string
 	TimedStatPeriods []Period
 	Stats            StatGroupConfig
 	Milestones       []MilestoneConfig
+	archive          *Archive
 }
 
 type StatGroupConfig struct {
@@ -51,10 +66,14 @@ type StatGroupConfig struct {
 }
 
 type StatConfig struct {
-	Name       string
-	Period     string
-	DataType   string
-	LoaderType string
+	Name           string
+	Period         string
+	DataType       string
+	LoaderType     string
+	UpdateMode     string
+	PollIntervalMs int
+	Fields         []string
+	Layout         string
 }
 
 type MilestoneConfig struct {
@@ -64,25 +83,136 @@ type MilestoneConfig struct {
 	Milestones []*Milestone
 }
 
-var Config tomlConfig
-
-func ParseConfig(configFile string) error {
+func ParseConfig(configFile string) (*Config, error) {
 	if configFile == "" {
-		return fmt.Errorf("config file not specified")
+		return nil, fmt.Errorf("config file not specified")
 	}
 	buf, err := ioutil.ReadFile(configFile)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	config := &Config{}
+	if err := toml.Unmarshal(buf, config); err != nil {
+		return nil, err
+	}
+	config.locations = newConfigLocations(buf)
+	if problems := checkConfig(config); len(problems) > 0 {
+		return nil, problems
 	}
-	if err := toml.Unmarshal(buf, &Config); err != nil {
-		return err
+	for i := range config.Sources {
+		sourceConfig := &config.Sources[i]
+		if sourceConfig.SnapshotFile != "" {
+			if sourceConfig.archive, err = ReadArchive(sourceConfig.SnapshotFile); err != nil {
+				return nil, fmt.Errorf("source %s: %v", sourceConfig.Name, err)
+			}
+		}
+	}
+	return config, nil
+}
+
+// Source returns the config of the named source, or the first source if name
+// is empty, or nil if there is no such source
+func (c *Config) Source(name string) *SourceConfig {
+	for i := range c.Sources {
+		if c.Sources[i].Name == name || (name == "" && i == 0) {
+			return &c.Sources[i]
+		}
 	}
 	return nil
 }
 
-func MakeSourcesFromConfig(config tomlConfig) (sources []*Source) {
+// Update modes: stats are updated when a message is published to their
+// updates channel, when their keys change according to Redis keyspace
+// notifications, or by polling at a fixed interval
+const (
+	UpdateModePublish  = "publish"
+	UpdateModeKeyspace = "keyspace"
+	UpdateModePoll     = "poll"
+)
+
+const DefaultPollIntervalMs = 5000
+
+// Periods returns the source's timed stat periods with timing settings not
+// overridden per period inherited from the source
+func (sc SourceConfig) Periods() ([]Period, error) {
+	return ResolvePeriods(sc.TimedStatPeriods, sc.EndGrace, sc.WholePeriodTail, sc.Timezone)
+}
+
+// StatConfigs returns the configs of all the source's stats, with the data
+// types of proportion, rolling and timed stats defaulted to their group
+func (sc SourceConfig) StatConfigs() (statConfigs []StatConfig) {
+	for _, configs := range sc.GroupedStatConfigs() {
+		statConfigs = append(statConfigs, configs...)
+	}
+	return
+}
+
+// GroupedStatConfigs returns the configs of the source's stats as per
+// StatConfigs, by the group they are published in
+func (sc SourceConfig) GroupedStatConfigs() map[string][]StatConfig {
+	grouped := make(map[string][]StatConfig)
+	for group, configs := range map[string][]StatConfig{"proportion": sc.Stats.Proportion, "rolling": sc.Stats.Rolling, "timed": sc.Stats.Timed, "other": sc.Stats.Other} {
+		for _, statConfig := range configs {
+			if statConfig.DataType == "" && group != "other" {
+				statConfig.DataType = group
+			}
+			grouped[group] = append(grouped[group], statConfig)
+		}
+	}
+	return grouped
+}
+
+// WithLoaderType returns the source config with all its stats using the
+// given loader type, e.g. "memory" to run without Redis
+func (sc SourceConfig) WithLoaderType(loaderType string) SourceConfig {
+	withLoaderType := func(statConfigs []StatConfig) (configs []StatConfig) {
+		for _, statConfig := range statConfigs {
+			statConfig.LoaderType = loaderType
+			configs = append(configs, statConfig)
+		}
+		return
+	}
+	sc.Stats = StatGroupConfig{
+		Proportion: withLoaderType(sc.Stats.Proportion),
+		Rolling:    withLoaderType(sc.Stats.Rolling),
+		Timed:      withLoaderType(sc.Stats.Timed),
+		Other:      withLoaderType(sc.Stats.Other),
+	}
+	return sc
+}
+
+// Key returns the key of the stat within its group, qualified by its period
+// if it has one
+func (sc StatConfig) Key() string {
+	if sc.Period != "" {
+		return sc.Period + ":" + sc.Name
+	}
+	return sc.Name
+}
+
+func (sc StatConfig) KeyMaker(redisPrefix string) RedisKeyMaker {
+	if sc.Period != "" {
+		return RedisKeyMaker{makeKey(redisPrefix, "rolling", sc.Period, "stats", sc.Name)}
+	}
+	return RedisKeyMaker{makeKey(redisPrefix, "stats", sc.Name)}
+}
+
+// MakeSourcesFromConfig makes the configured sources, whose Redis stats get
+// connections from pool
+func MakeSourcesFromConfig(config *Config, pool *redis.Pool) []*Source {
+	return MakeSourcesFromConfigWithClock(config, pool, SystemClock)
+}
+
+// MakeSourcesFromConfigWithClock makes sources whose stats, milestones and
+// announcements use the given clock, e.g. to replay recorded refreshes
+func MakeSourcesFromConfigWithClock(config *Config, pool *redis.Pool, clock Clock) (sources []*Source) {
 	for _, sourceConfig := range config.Sources {
-		source := Source{Name: sourceConfig.Name, IsLive: sourceConfig.IsLive}
+		source := Source{Name: sourceConfig.Name, IsLive: sourceConfig.IsLive, TimedDeltas: sourceConfig.TimedDeltas, Debounce: config.Debounce}
+		source.redisPool = pool
+		source.redisSubscriber = NewRedisSubscriber(pool, sourceConfig.RedisPrefix)
+		source.redisKeyspaceSubscriber = NewRedisKeyspaceSubscriber(pool, config.Redis.orDefault().DB, sourceConfig.RedisPrefix)
+		source.Clock = clock
+		source.scheduler = NewScheduler(source.Clock)
 		source.Available = make(map[string][]string)
 		source.Stats = make(map[string]map[string]*Stat)
 
@@ -94,7 +224,7 @@ func MakeSourcesFromConfig(config tomlConfig) (sources []*Source) {
 			if statConfig.DataType == "" {
 				statConfig.DataType = "proportion"
 			}
-			stat := MakeStatFromConfig(sourceConfig, statConfig)
+			stat := source.MakeStatFromConfig(sourceConfig, statConfig)
 			source.Available["proportion"] = append(source.Available["proportion"], stat.Name)
 			source.Stats["proportion"][stat.Name] = stat
 		}
@@ -107,7 +237,7 @@ func MakeSourcesFromConfig(config tomlConfig) (sources []*Source) {
 			if statConfig.DataType == "" {
 				statConfig.DataType = "rolling"
 			}
-			stat := MakeStatFromConfig(sourceConfig, statConfig)
+			stat := source.MakeStatFromConfig(sourceConfig, statConfig)
 			source.Available["rolling"] = append(source.Available["rolling"], statConfig.Period+":"+stat.Name)
 			source.Stats["rolling"][statConfig.Period+":"+stat.Name] = stat
 		}
@@ -120,7 +250,7 @@ func MakeSourcesFromConfig(config tomlConfig) (sources []*Source) {
 			if statConfig.DataType == "" {
 				statConfig.DataType = "timed"
 			}
-			stat := MakeStatFromConfig(sourceConfig, statConfig)
+			stat := source.MakeStatFromConfig(sourceConfig, statConfig)
 			source.Available["timed"] = append(source.Available["timed"], stat.Name)
 			source.Stats["timed"][stat.Name] = stat
 		}
@@ -131,7 +261,7 @@ func MakeSourcesFromConfig(config tomlConfig) (sources []*Source) {
 			if source.Stats["other"] == nil {
 				source.Stats["other"] = make(map[string]*Stat)
 			}
-			stat := MakeStatFromConfig(sourceConfig, statConfig)
+			stat := source.MakeStatFromConfig(sourceConfig, statConfig)
 			if statConfig.Period != "" {
 				statKey = statConfig.Period + ":" + stat.Name
 			} else {
@@ -152,6 +282,11 @@ func MakeSourcesFromConfig(config tomlConfig) (sources []*Source) {
 				Name:       milestoneConfig.Name,
 				Stat:       source.Stats[milestoneConfig.Group][milestoneConfig.Stat],
 				Milestones: milestoneConfig.Milestones,
+				Clock:      source.Clock,
+			}
+			// Milestones of archived sources keep their original states
+			if sourceConfig.archive != nil {
+				milestoneCollection.Restore(sourceConfig.archive.Milestones[milestoneCollection.Name])
 			}
 			source.Milestones = append(source.Milestones, milestoneCollection)
 		}
@@ -161,44 +296,141 @@ func MakeSourcesFromConfig(config tomlConfig) (sources []*Source) {
 	return sources
 }
 
-func MakeStatFromConfig(sourceConfig SourceConfig, statConfig StatConfig) *Stat {
+// memoryStore returns the source's memory store, making it if need be
+func (s *Source) memoryStore() *MemoryStore {
+	if s.MemoryStore == nil {
+		s.MemoryStore = NewMemoryStore()
+	}
+	return s.MemoryStore
+}
+
+// memoryLoader returns the loaders of a stat held in the memory store, and
+// its update listener: memory stats are updated through the store, but may
+// still poll
+func (s *Source) memoryLoader(sourceConfig SourceConfig, statConfig StatConfig, store *MemoryStore, updateMode string, pollUpdateListener *PollUpdateListener) (dataLoader StatDataLoader, dataPointLoader StatDataPointLoader, updateListener StatUpdateListener) {
+	memoryKeyMaker := MemoryKeyMaker{statConfig.KeyMaker(sourceConfig.RedisPrefix), store}
+	dataPointLoader = &MemoryDataPointLoader{memoryKeyMaker}
+	if updateMode == UpdateModePoll {
+		updateListener = pollUpdateListener
+	} else {
+		updateListener = &MemoryUpdateListener{memoryKeyMaker}
+	}
+
+	switch statConfig.DataType {
+	case "generic":
+		dataLoader = &GenericDataLoaderMemory{memoryKeyMaker}
+	case "proportion":
+		dataLoader = &ProportionDataLoaderMemory{memoryKeyMaker}
+	case "rolling":
+		dataLoader = &RollingDataLoaderMemory{memoryKeyMaker}
+	case "single_value":
+		dataLoader = &SingleValueDataLoaderMemory{memoryKeyMaker}
+	case "timed":
+		// Timezones are checked by ParseConfig, so ignore errors here
+		periods, _ := sourceConfig.Periods()
+		dataLoader = &TimedDataLoaderMemory{
+			MemoryKeyMaker: memoryKeyMaker,
+			StartTime:      sourceConfig.StartTime,
+			EndTime:        sourceConfig.EndTime,
+			Fields:         statConfig.Fields,
+			Periods:        periods,
+			Clock:          s.Clock,
+		}
+		dataPointLoader = &TimedDataPointLoaderMemory{
+			MemoryKeyMaker: memoryKeyMaker,
+			Periods:        periods,
+		}
+	}
+	return dataLoader, dataPointLoader, updateListener
+}
+
+// MakeStatFromConfig creates a stat of the source. Stats using Redis share
+// the source's pool and its pub/sub connection to listen for updates, stats
+// held in memory or loaded from the source's snapshot file share the source's
+// memory store, and all stats share the source's scheduler
+func (s *Source) MakeStatFromConfig(sourceConfig SourceConfig, statConfig StatConfig) *Stat {
 	var (
 		dataLoader      StatDataLoader
 		dataPointLoader StatDataPointLoader
 		updateListener  StatUpdateListener
 	)
 
-	if statConfig.LoaderType == "redis" {
-		var keyMaker RedisKeyMaker
-		if statConfig.Period != "" {
-			keyMaker = RedisKeyMaker{makeKey(sourceConfig.RedisPrefix, "rolling", statConfig.Period, "stats", statConfig.Name)}
-		} else {
-			keyMaker = RedisKeyMaker{makeKey(sourceConfig.RedisPrefix, "stats", statConfig.Name)}
+	keyMaker := statConfig.KeyMaker(sourceConfig.RedisPrefix)
+
+	// Stat update mode and poll interval override the source's
+	updateMode, pollIntervalMs := sourceConfig.UpdateMode, sourceConfig.PollIntervalMs
+	if statConfig.UpdateMode != "" {
+		updateMode = statConfig.UpdateMode
+	}
+	if statConfig.PollIntervalMs != 0 {
+		pollIntervalMs = statConfig.PollIntervalMs
+	}
+	if pollIntervalMs <= 0 {
+		pollIntervalMs = DefaultPollIntervalMs
+	}
+	pollUpdateListener := &PollUpdateListener{Interval: time.Duration(pollIntervalMs) * time.Millisecond, Clock: s.Clock}
+
+	// Timezones are checked by ParseConfig, so ignore errors here
+	periods, _ := sourceConfig.Periods()
+
+	switch statConfig.LoaderType {
+	case "redis":
+		redisKeyMaker := RedisPoolKeyMaker{keyMaker, s.redisPool}
+		dataPointLoader = &RedisDataPointLoader{redisKeyMaker}
+
+		switch updateMode {
+		case UpdateModeKeyspace:
+			updateListener = &RedisUpdateListener{redisKeyMaker, s.redisSubscriber, s.redisKeyspaceSubscriber}
+		case UpdateModePoll:
+			updateListener = pollUpdateListener
+		default:
+			updateListener = &RedisUpdateListener{redisKeyMaker, s.redisSubscriber, nil}
 		}
-		dataPointLoader = &RedisDataPointLoader{keyMaker}
-		updateListener = &RedisUpdateListener{keyMaker}
 
 		switch statConfig.DataType {
 		case "generic":
-			dataLoader = &GenericDataLoaderRedis{keyMaker}
+			dataLoader = &GenericDataLoaderRedis{redisKeyMaker}
 		case "proportion":
-			dataLoader = &ProportionDataLoaderRedis{keyMaker}
+			dataLoader = &ProportionDataLoaderRedis{redisKeyMaker}
 		case "rolling":
-			dataLoader = &RollingDataLoaderRedis{keyMaker}
+			dataLoader = &RollingDataLoaderRedis{redisKeyMaker}
 		case "single_value":
-			dataLoader = &SingleValueDataLoaderRedis{keyMaker}
+			dataLoader = &SingleValueDataLoaderRedis{redisKeyMaker}
 		case "timed":
 			dataLoader = &TimedDataLoaderRedis{
-				RedisKeyMaker: keyMaker,
-				StartTime:     sourceConfig.StartTime,
-				EndTime:       sourceConfig.EndTime,
-				Periods:       sourceConfig.TimedStatPeriods,
+				RedisPoolKeyMaker: redisKeyMaker,
+				StartTime:         sourceConfig.StartTime,
+				EndTime:           sourceConfig.EndTime,
+				Fields:            statConfig.Fields,
+				Layout:            statConfig.Layout,
+				Periods:           periods,
+				Clock:             s.Clock,
 			}
 			dataPointLoader = &TimedDataPointLoaderRedis{
-				RedisKeyMaker: keyMaker,
-				Periods:       sourceConfig.TimedStatPeriods,
+				RedisPoolKeyMaker: redisKeyMaker,
+				Periods:           periods,
 			}
 		}
+	case "file":
+		// Stats loaded from a snapshot are served from the memory store
+		store := s.memoryStore()
+		if sourceConfig.archive != nil {
+			if snapshotStat, ok := sourceConfig.archive.Stats.Stat(statConfig.Key()); ok {
+				snapshotStat.Store(store, keyMaker.RedisPrefix, statConfig.DataType, statConfig.Fields)
+			}
+		}
+		dataLoader, dataPointLoader, updateListener = s.memoryLoader(sourceConfig, statConfig, store, updateMode, pollUpdateListener)
+	case "upstream":
+		// Stats followed from an upstream server are received into the
+		// memory store, from which they are served
+		store := s.memoryStore()
+		if s.upstream == nil {
+			s.upstream = NewUpstreamClient(sourceConfig.UpstreamURL, store)
+		}
+		s.upstream.Follow(statConfig.Key(), keyMaker.RedisPrefix, statConfig.DataType, statConfig.Fields)
+		dataLoader, dataPointLoader, updateListener = s.memoryLoader(sourceConfig, statConfig, store, updateMode, pollUpdateListener)
+	case "memory":
+		dataLoader, dataPointLoader, updateListener = s.memoryLoader(sourceConfig, statConfig, s.memoryStore(), updateMode, pollUpdateListener)
 	}
 
 	return &Stat{
@@ -206,5 +438,7 @@ func MakeStatFromConfig(sourceConfig SourceConfig, statConfig StatConfig) *Stat
 		DataLoader:      dataLoader,
 		DataPointLoader: dataPointLoader,
 		UpdateListener:  updateListener,
+		Scheduler:       s.scheduler,
+		Clock:           s.Clock,
 	}
 }
@@ -0,0 +1,330 @@
+package arithmospora
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/naoina/toml"
+	"github.com/naoina/toml/ast"
+)
+
+// ConfigProblem is a problem found validating the config, with the line of
+// the config file at which it was found, or zero if unknown
+type ConfigProblem struct {
+	Line    int
+	Message string
+}
+
+func (cp ConfigProblem) String() string {
+	if cp.Line == 0 {
+		return cp.Message
+	}
+	return fmt.Sprintf("line %v: %s", cp.Line, cp.Message)
+}
+
+// ConfigProblems lists every problem found validating the config, and is
+// returned as a single error by ParseConfig
+type ConfigProblems []ConfigProblem
+
+func (cp ConfigProblems) Error() string {
+	lines := make([]string, len(cp))
+	for i, problem := range cp {
+		lines[i] = problem.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// configLocations maps paths within the config, such as
+// sources[0].stats.other[1].datatype, to their lines in the config file. Keys
+// are normalised as by the TOML decoder: lower case without underscores
+type configLocations map[string]int
+
+func newConfigLocations(buf []byte) configLocations {
+	locations := make(configLocations)
+	if table, err := toml.Parse(buf); err == nil {
+		locations.add("", table)
+	}
+	return locations
+}
+
+func (cl configLocations) add(path string, node interface{}) {
+	switch node := node.(type) {
+	case *ast.Table:
+		cl[path] = node.Line
+		for key, field := range node.Fields {
+			cl.add(cl.join(path, key), field)
+		}
+	case []*ast.Table:
+		for i, table := range node {
+			cl.add(fmt.Sprintf("%s[%v]", path, i), table)
+		}
+	case *ast.KeyValue:
+		cl[path] = node.Line
+	}
+}
+
+func (cl configLocations) join(path string, key string) string {
+	key = strings.ToLower(strings.Replace(key, "_", "", -1))
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// line returns the line of the given path, or of its closest ancestor
+// present in the config file
+func (cl configLocations) line(path string) int {
+	for path != "" {
+		if line, ok := cl[path]; ok {
+			return line
+		}
+		if i := strings.LastIndexAny(path, ".["); i >= 0 {
+			path = path[:i]
+		} else {
+			path = ""
+		}
+	}
+	return 0
+}
+
+// configChecker accumulates the problems found validating a config
+type configChecker struct {
+	locations configLocations
+	problems  ConfigProblems
+}
+
+func (cc *configChecker) report(path string, format string, args ...interface{}) {
+	cc.problems = append(cc.problems, ConfigProblem{cc.locations.line(path), fmt.Sprintf(format, args...)})
+}
+
+var (
+	configDataTypes   = []string{"proportion", "rolling", "timed", "single_value", "generic"}
+	configLoaderTypes = []string{"redis", "memory", "file", "upstream"}
+	configComparators = []string{">", ">=", "=", "<=", "<"}
+
+	configSlowClientPolicies = []string{SlowClientDisconnect, SlowClientDropOldest, SlowClientSnapshot}
+	configClusterRoles       = []string{ClusterLeader, ClusterFollower}
+)
+
+func configOneOf(value string, values []string) bool {
+	for _, v := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConfig validates the config, returning every problem found
+func checkConfig(config *Config) ConfigProblems {
+	cc := &configChecker{locations: config.locations}
+	sourceNames := make(map[string]bool)
+	for i, sourceConfig := range config.Sources {
+		sourcePath := fmt.Sprintf("sources[%v]", i)
+		if sourceConfig.Name == "" {
+			cc.report(sourcePath, "source has no name")
+		} else if sourceNames[sourceConfig.Name] {
+			cc.report(sourcePath+".name", "duplicate source %s", sourceConfig.Name)
+		}
+		sourceNames[sourceConfig.Name] = true
+		cc.checkSource(sourcePath, sourceConfig)
+	}
+	if config.Websocket.Shards < 0 {
+		cc.report("websocket.shards", "websocket: shards must not be negative")
+	}
+	if policy := config.Websocket.SlowClientPolicy; policy != "" && !configOneOf(policy, configSlowClientPolicies) {
+		cc.report("websocket.slowclientpolicy", "websocket: invalid slow_client_policy %q: must be one of %s", policy, strings.Join(configSlowClientPolicies, ", "))
+	}
+	if config.Websocket.SlowClientGrace < 0 {
+		cc.report("websocket.slowclientgrace", "websocket: slow_client_grace must not be negative")
+	}
+	if config.Websocket.ReplayBuffer < 0 {
+		cc.report("websocket.replaybuffer", "websocket: replay_buffer must not be negative")
+	}
+	if config.Websocket.ReadyTimeoutMs < 0 {
+		cc.report("websocket.readytimeoutms", "websocket: ready_timeout_ms must not be negative")
+	}
+	if role := config.Cluster.Role; role != "" {
+		if !configOneOf(role, configClusterRoles) {
+			cc.report("cluster.role", "cluster: invalid role %q: must be one of %s", role, strings.Join(configClusterRoles, ", "))
+		} else if config.Cluster.Address == "" {
+			cc.report("cluster", "cluster: address is required for a %s", role)
+		}
+	}
+	return cc.problems
+}
+
+func (cc *configChecker) checkSource(sourcePath string, sourceConfig SourceConfig) {
+	name := sourceConfig.Name
+	if !sourceConfig.StartTime.IsZero() && !sourceConfig.EndTime.IsZero() && sourceConfig.EndTime.Before(sourceConfig.StartTime) {
+		cc.report(sourcePath+".endtime", "source %s: end_time %v is before start_time %v", name, sourceConfig.EndTime, sourceConfig.StartTime)
+	}
+	if _, err := sourceConfig.Periods(); err != nil {
+		cc.report(sourcePath+".timedstatperiods", "source %s: %v", name, err)
+	}
+	cc.checkUpdateMode(sourcePath+".updatemode", "source "+name, sourceConfig.UpdateMode)
+
+	// Stats, whose keys must be unique within their group
+	groups := []struct {
+		name    string
+		configs []StatConfig
+	}{
+		{"proportion", sourceConfig.Stats.Proportion},
+		{"rolling", sourceConfig.Stats.Rolling},
+		{"timed", sourceConfig.Stats.Timed},
+		{"other", sourceConfig.Stats.Other},
+	}
+	statKeys := make(map[string]map[string]bool)
+	for _, group := range groups {
+		statKeys[group.name] = make(map[string]bool)
+		for i, statConfig := range group.configs {
+			statPath := fmt.Sprintf("%s.stats.%s[%v]", sourcePath, group.name, i)
+			if statKeys[group.name][statConfig.Key()] {
+				cc.report(statPath, "source %s: duplicate %s stat %s", name, group.name, statConfig.Key())
+			}
+			statKeys[group.name][statConfig.Key()] = true
+			cc.checkStat(statPath, sourceConfig, group.name, statConfig)
+		}
+	}
+
+	// Milestones must refer to a stat of the source
+	for i, milestoneConfig := range sourceConfig.Milestones {
+		milestonePath := fmt.Sprintf("%s.milestones[%v]", sourcePath, i)
+		if !statKeys[milestoneConfig.Group][milestoneConfig.Stat] {
+			cc.report(milestonePath, "source %s: milestones %s refer to missing %s stat %s", name, milestoneConfig.Name, milestoneConfig.Group, milestoneConfig.Stat)
+		}
+		for j, milestone := range milestoneConfig.Milestones {
+			if !configOneOf(milestone.Comparator, configComparators) {
+				cc.report(fmt.Sprintf("%s.milestones[%v].comparator", milestonePath, j), "source %s: milestone %s has invalid comparator %q: must be one of %s", name, milestone.Name, milestone.Comparator, strings.Join(configComparators, ", "))
+			}
+		}
+	}
+}
+
+func (cc *configChecker) checkStat(statPath string, sourceConfig SourceConfig, group string, statConfig StatConfig) {
+	name := "source " + sourceConfig.Name + ": " + group + " stat " + statConfig.Key()
+	if statConfig.Name == "" {
+		cc.report(statPath, "source %s: %s stat has no name", sourceConfig.Name, group)
+	}
+
+	dataType := statConfig.DataType
+	if dataType == "" && group != "other" {
+		dataType = group
+	}
+	switch {
+	case dataType == "":
+		cc.report(statPath, "%s: data_type is required for other stats", name)
+	case !configOneOf(dataType, configDataTypes):
+		cc.report(statPath+".datatype", "%s: invalid data_type %q: must be one of %s", name, dataType, strings.Join(configDataTypes, ", "))
+	}
+	if !configOneOf(statConfig.LoaderType, configLoaderTypes) {
+		cc.report(statPath+".loadertype", "%s: invalid loader_type %q: must be one of %s", name, statConfig.LoaderType, strings.Join(configLoaderTypes, ", "))
+	}
+	if statConfig.LoaderType == "file" && sourceConfig.SnapshotFile == "" {
+		cc.report(statPath+".loadertype", "%s: loader_type file requires the source's snapshot_file", name)
+	}
+	if statConfig.LoaderType == "upstream" && sourceConfig.UpstreamURL == "" {
+		cc.report(statPath+".loadertype", "%s: loader_type upstream requires the source's upstream_url", name)
+	}
+	if statConfig.LoaderType == "upstream" && !sourceConfig.IsLive {
+		cc.report(statPath+".loadertype", "%s: loader_type upstream requires the source to be live, as its updates are otherwise never applied", name)
+	}
+	if group == "rolling" && statConfig.Period == "" {
+		cc.report(statPath, "%s: rolling stats require a period", name)
+	}
+	switch statConfig.Layout {
+	case "", TimedLayoutHash, TimedLayoutJSON:
+	default:
+		cc.report(statPath+".layout", "%s: invalid layout %q: must be %s or %s", name, statConfig.Layout, TimedLayoutHash, TimedLayoutJSON)
+	}
+	cc.checkUpdateMode(statPath+".updatemode", name, statConfig.UpdateMode)
+}
+
+func (cc *configChecker) checkUpdateMode(path string, name string, mode string) {
+	switch mode {
+	case "", UpdateModePublish, UpdateModeKeyspace, UpdateModePoll:
+	default:
+		cc.report(path, "%s: invalid update_mode %q: must be one of %s, %s, %s", name, mode, UpdateModePublish, UpdateModeKeyspace, UpdateModePoll)
+	}
+}
+
+// CheckRedisKeys checks that the Redis keys read by the config's Redis
+// loaded stats exist and have the types expected by their loaders, using a
+// connection from pool, and returns every problem found
+func CheckRedisKeys(config *Config, pool *redis.Pool) (ConfigProblems, error) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	type expectedKey struct {
+		path     string
+		name     string
+		key      string
+		keyType  string
+		optional bool
+	}
+	var expected []expectedKey
+	for i, sourceConfig := range config.Sources {
+		periods, _ := sourceConfig.Periods()
+		for group, statConfigs := range map[string][]StatConfig{"proportion": sourceConfig.Stats.Proportion, "rolling": sourceConfig.Stats.Rolling, "timed": sourceConfig.Stats.Timed, "other": sourceConfig.Stats.Other} {
+			for j, statConfig := range statConfigs {
+				if statConfig.LoaderType != "redis" {
+					continue
+				}
+				path := fmt.Sprintf("sources[%v].stats.%s[%v]", i, group, j)
+				name := "source " + sourceConfig.Name + ": " + group + " stat " + statConfig.Key()
+				keyMaker := statConfig.KeyMaker(sourceConfig.RedisPrefix)
+				dataType := statConfig.DataType
+				if dataType == "" {
+					dataType = group
+				}
+				switch dataType {
+				case "single_value":
+					expected = append(expected, expectedKey{path, name, keyMaker.MakeKey("data"), "string", false})
+				case "timed":
+					// Timed stats hold their buckets in their periods'
+					// datapoints, except for derived periods
+					for _, period := range periods {
+						if period.Aggregate != "" {
+							continue
+						}
+						dataKey := keyMaker.MakeKey("datapoints", period.DataPointName(), "data")
+						if len(statConfig.Fields) == 0 || statConfig.Layout == TimedLayoutJSON {
+							expected = append(expected, expectedKey{path, name, dataKey, "hash", false})
+							continue
+						}
+						for _, field := range statConfig.Fields {
+							expected = append(expected, expectedKey{path, name, makeKey(dataKey, field), "hash", false})
+						}
+					}
+				default:
+					expected = append(expected, expectedKey{path, name, keyMaker.MakeKey("data"), "hash", false})
+					expected = append(expected, expectedKey{path, name, keyMaker.MakeKey("datapoints"), "set", true})
+				}
+			}
+		}
+	}
+
+	for _, e := range expected {
+		if err := conn.Send("TYPE", e.key); err != nil {
+			return nil, err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	cc := &configChecker{locations: config.locations}
+	for _, e := range expected {
+		keyType, err := redis.String(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case keyType == "none" && !e.optional:
+			cc.report(e.path, "%s: redis key %s does not exist", e.name, e.key)
+		case keyType != "none" && keyType != e.keyType:
+			cc.report(e.path, "%s: redis key %s is a %s, expected a %s", e.name, e.key, keyType, e.keyType)
+		}
+	}
+	return cc.problems, nil
+}
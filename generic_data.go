@@ -40,11 +40,11 @@ func (gd *GenericData) MilestoneValue(field string) float64 {
 }
 
 type GenericDataLoaderRedis struct {
-	RedisKeyMaker
+	RedisPoolKeyMaker
 }
 
 func (gdl *GenericDataLoaderRedis) FetchData() (map[string]int, error) {
-	conn := RedisPool().Get()
+	conn := gdl.Pool.Get()
 	defer conn.Close()
 
 	return redis.IntMap(conn.Do("HGETALL", gdl.MakeKey("data")))
@@ -58,3 +58,22 @@ func (gdl *GenericDataLoaderRedis) Load(*Stat) (StatData, error) {
 
 	return &GenericData{Data: data, dataLoader: gdl}, nil
 }
+
+type GenericDataLoaderMemory struct {
+	MemoryKeyMaker
+}
+
+func (gdl *GenericDataLoaderMemory) FetchData() (map[string]int, error) {
+	data := make(map[string]int)
+	if stored, ok := gdl.Store.get(gdl.MakeKey()).(map[string]int); ok {
+		for field, value := range stored {
+			data[field] = value
+		}
+	}
+	return data, nil
+}
+
+func (gdl *GenericDataLoaderMemory) Load(*Stat) (StatData, error) {
+	data, _ := gdl.FetchData()
+	return &GenericData{Data: data, dataLoader: gdl}, nil
+}
@@ -0,0 +1,58 @@
+package arithmospora
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// BenchmarkHubBroadcast measures fanning a broadcast out to ready clients
+// across shards, until every client has been sent it. Clients which fall too
+// far behind are disconnected, as by default, rather than left waiting for
+// messages dropped from their backlog
+func BenchmarkHubBroadcast(b *testing.B) {
+	const clientCount = 1000
+	message, err := json.Marshal(Message{Event: "stats:proportion:total", Payload: map[string]int{"current": 1, "total": 2}})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, shards := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			source := &Source{Name: "election"}
+			hub := NewHub(source, WebsocketConfig{Shards: shards})
+			var received sync.WaitGroup
+			for i := 0; i < clientCount; i++ {
+				shard := hub.shards[i%shards]
+				client := &Client{hub: hub, shard: shard, send: make(chan []byte, clientSendBuffer), closed: make(chan struct{}), ready: true}
+				shard.clients[client] = true
+				atomic.AddInt64(&hub.clientCount, 1)
+				received.Add(1)
+				go func() {
+					defer received.Done()
+					for n := 0; n < b.N; n++ {
+						if _, ok := <-client.send; !ok {
+							return
+						}
+					}
+				}()
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			go hub.Run(ctx)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				hub.broadcast(message)
+			}
+			received.Wait()
+			b.StopTimer()
+
+			cancel()
+			<-hub.done
+		})
+	}
+}
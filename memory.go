@@ -0,0 +1,198 @@
+package arithmospora
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// MemoryStore holds stat data in memory for stats with loader_type "memory",
+// using the same key layout as Redis, e.g. <prefix>:stats:<name>. Values are
+// set programmatically and Update notifies the stats listening on a key,
+// making the store suitable for tests and demonstrations without Redis.
+type MemoryStore struct {
+	mu         sync.Mutex
+	values     map[string]interface{}
+	buckets    map[string]map[int64]Bucket
+	dataPoints map[string][]string
+	listeners  map[string][]memoryListener
+}
+
+// memoryListener is a subscription to updates of a key, which ends once done
+type memoryListener struct {
+	updated chan<- bool
+	done    <-chan struct{}
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		values:     make(map[string]interface{}),
+		buckets:    make(map[string]map[int64]Bucket),
+		dataPoints: make(map[string][]string),
+		listeners:  make(map[string][]memoryListener),
+	}
+}
+
+func (ms *MemoryStore) set(key string, value interface{}) {
+	ms.mu.Lock()
+	ms.values[key] = value
+	ms.mu.Unlock()
+}
+
+func (ms *MemoryStore) get(key string) interface{} {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.values[key]
+}
+
+// SetGeneric sets the data of a generic stat
+func (ms *MemoryStore) SetGeneric(key string, data map[string]int) {
+	copied := make(map[string]int, len(data))
+	for field, value := range data {
+		copied[field] = value
+	}
+	ms.set(key, copied)
+}
+
+func (ms *MemoryStore) SetProportion(key string, current int, total int) {
+	ms.set(key, []int{current, total})
+}
+
+func (ms *MemoryStore) SetRolling(key string, current int, total int, peak int) {
+	ms.set(key, []int{current, total, peak})
+}
+
+func (ms *MemoryStore) SetSingleValue(key string, value int) {
+	ms.set(key, value)
+}
+
+// SetBucket sets the values of a timed stat bucket, one per field. The key
+// of a timed stat's bucket is that of its period datapoint, e.g.
+// <prefix>:stats:<name>:datapoints:3600
+func (ms *MemoryStore) SetBucket(key string, bucket int64, values ...float64) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.buckets[key] == nil {
+		ms.buckets[key] = make(map[int64]Bucket)
+	}
+	ms.buckets[key][bucket] = append(Bucket(nil), values...)
+}
+
+// SetDataPoints sets the names of the datapoints of a stat
+func (ms *MemoryStore) SetDataPoints(key string, dpNames ...string) {
+	ms.mu.Lock()
+	ms.dataPoints[key] = append([]string(nil), dpNames...)
+	ms.mu.Unlock()
+}
+
+// Delete removes the data, buckets and datapoint names held at key
+func (ms *MemoryStore) Delete(key string) {
+	ms.mu.Lock()
+	delete(ms.values, key)
+	delete(ms.buckets, key)
+	delete(ms.dataPoints, key)
+	ms.mu.Unlock()
+}
+
+// Update notifies the stats listening on key that their data has changed,
+// as publishing to the stat's updates channel does for Redis
+func (ms *MemoryStore) Update(key string) {
+	ms.mu.Lock()
+	listeners := append([]memoryListener(nil), ms.listeners[key]...)
+	ms.mu.Unlock()
+	for _, listener := range listeners {
+		select {
+		case listener.updated <- true:
+		case <-listener.done:
+		}
+	}
+}
+
+// Subscribe registers updated to receive true as key is updated, until ctx
+// is done
+func (ms *MemoryStore) Subscribe(ctx context.Context, key string, updated chan<- bool) {
+	listener := memoryListener{updated, ctx.Done()}
+	ms.mu.Lock()
+	ms.listeners[key] = append(ms.listeners[key], listener)
+	ms.mu.Unlock()
+
+	if listener.done == nil {
+		return
+	}
+	go func() {
+		<-listener.done
+		ms.mu.Lock()
+		defer ms.mu.Unlock()
+		for i, l := range ms.listeners[key] {
+			if l == listener {
+				ms.listeners[key] = append(ms.listeners[key][:i:i], ms.listeners[key][i+1:]...)
+				break
+			}
+		}
+		if len(ms.listeners[key]) == 0 {
+			delete(ms.listeners, key)
+		}
+	}()
+}
+
+func (ms *MemoryStore) fetchBuckets(key string, keys []int64, fieldCount int) []Bucket {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	buckets := make([]Bucket, len(keys))
+	for i, bucketKey := range keys {
+		buckets[i] = make(Bucket, fieldCount)
+		copy(buckets[i], ms.buckets[key][bucketKey])
+	}
+	return buckets
+}
+
+func (ms *MemoryStore) dataPointNames(key string) []string {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	dpNames := append([]string(nil), ms.dataPoints[key]...)
+	sort.Strings(dpNames)
+	return dpNames
+}
+
+// MemoryKeyMaker makes the keys of a stat held in a memory store
+type MemoryKeyMaker struct {
+	RedisKeyMaker
+	Store *MemoryStore
+}
+
+type MemoryDataPointLoader struct {
+	MemoryKeyMaker
+}
+
+func (mdpl *MemoryDataPointLoader) DataPointNames() ([]string, error) {
+	return mdpl.Store.dataPointNames(mdpl.MakeKey()), nil
+}
+
+// NewDataLoader copies the stat's loader, which keeps its store, with the
+// prefix of the datapoint
+func (mdpl *MemoryDataPointLoader) NewDataLoader(sdl StatDataLoader, dpName string) StatDataLoader {
+	val := reflect.ValueOf(sdl)
+	if val.Kind() == reflect.Ptr {
+		val = reflect.Indirect(val)
+	}
+	copied := reflect.New(val.Type())
+	copied.Elem().Set(val)
+	mdl := copied.Interface().(RedisDataLoader)
+	mdl.SetRedisPrefix(mdpl.MakeKey("datapoints", dpName))
+	return mdl
+}
+
+func (mdpl *MemoryDataPointLoader) NewDataPointLoader(dpName string) StatDataPointLoader {
+	return &MemoryDataPointLoader{MemoryKeyMaker{RedisKeyMaker{RedisPrefix: mdpl.MakeKey("datapoints", dpName)}, mdpl.Store}}
+}
+
+// MemoryUpdateListener signals an update whenever the memory store is
+// updated at the stat's key
+type MemoryUpdateListener struct {
+	MemoryKeyMaker
+}
+
+func (mul *MemoryUpdateListener) Subscribe(ctx context.Context, updated chan<- bool, errors chan<- error) {
+	mul.Store.Subscribe(ctx, mul.MakeKey(), updated)
+}
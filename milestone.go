@@ -1,6 +1,7 @@
 package arithmospora
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
@@ -22,7 +23,7 @@ type Milestone struct {
 	AchievedWhen time.Time `json:"achievedWhen"`
 }
 
-func (m *Milestone) NewlyMet(stat *Stat) bool {
+func (m *Milestone) NewlyMet(stat *Stat, now time.Time) bool {
 	m.Lock()
 	defer m.Unlock()
 
@@ -59,7 +60,7 @@ func (m *Milestone) NewlyMet(stat *Stat) bool {
 
 	if result {
 		m.Achieved = true
-		m.AchievedWhen = time.Now()
+		m.AchievedWhen = now
 	}
 
 	return result
@@ -75,24 +76,79 @@ type MilestoneCollection struct {
 	Name       string
 	Stat       *Stat
 	Milestones []*Milestone
+	Clock      Clock
 }
 
-func (mc *MilestoneCollection) Publish(achieved chan<- *Milestone) {
-	// Check milestones to see if they have already achieved before the program
-	// started
+// MilestoneState records whether a milestone has been achieved, and when
+type MilestoneState struct {
+	Name         string    `json:"name"`
+	Achieved     bool      `json:"achieved"`
+	AchievedWhen time.Time `json:"achievedWhen"`
+}
+
+// Check flags milestones already met by the stat as achieved, without
+// publishing them
+func (mc *MilestoneCollection) Check() {
+	clock := clockOrSystem(mc.Clock)
 	for _, milestone := range mc.Milestones {
-		_ = milestone.NewlyMet(mc.Stat)
+		_ = milestone.NewlyMet(mc.Stat, clock.Now())
 	}
+}
+
+func (mc *MilestoneCollection) States() (states []MilestoneState) {
+	for _, milestone := range mc.Milestones {
+		milestone.Lock()
+		states = append(states, MilestoneState{milestone.Name, milestone.Achieved, milestone.AchievedWhen})
+		milestone.Unlock()
+	}
+	return
+}
+
+// Restore flags the milestones recorded as achieved in the given states as
+// achieved at their original times
+func (mc *MilestoneCollection) Restore(states []MilestoneState) {
+	for _, state := range states {
+		if !state.Achieved {
+			continue
+		}
+		for _, milestone := range mc.Milestones {
+			if milestone.Name == state.Name {
+				milestone.Lock()
+				milestone.Achieved, milestone.AchievedWhen = true, state.AchievedWhen
+				milestone.Unlock()
+			}
+		}
+	}
+}
+
+// Publish sends milestones on achieved as the stat's updates meet them, until
+// ctx is done
+func (mc *MilestoneCollection) Publish(ctx context.Context, achieved chan<- *Milestone) {
+	// Check milestones to see if they have already achieved before the program
+	// started
+	mc.Check()
+	clock := clockOrSystem(mc.Clock)
 
 	// Listen for updates from stat and publish when milestones are met
+	listener := mc.Stat.Listen(ctx, "milestones:"+mc.Name)
 	go func() {
-		statUpdated := make(chan bool)
-		mc.Stat.RegisterListener(statUpdated)
 		for {
-			_ = <-statUpdated
+			select {
+			case <-listener.Ready():
+			case <-listener.Done():
+				return
+			}
+			if _, ok := listener.Next(); !ok {
+				continue
+			}
 			for _, milestone := range mc.Milestones {
-				if milestone.NewlyMet(mc.Stat) {
-					achieved <- milestone
+				if !milestone.NewlyMet(mc.Stat, clock.Now()) {
+					continue
+				}
+				select {
+				case achieved <- milestone:
+				case <-ctx.Done():
+					return
 				}
 			}
 		}
@@ -61,11 +61,11 @@ func (pd *ProportionData) MilestoneValue(field string) float64 {
 }
 
 type ProportionDataLoaderRedis struct {
-	RedisKeyMaker
+	RedisPoolKeyMaker
 }
 
 func (pdl *ProportionDataLoaderRedis) FetchData() ([]int, error) {
-	conn := RedisPool().Get()
+	conn := pdl.Pool.Get()
 	defer conn.Close()
 
 	return redis.Ints(conn.Do("HMGET", pdl.MakeKey("data"), "current", "total"))
@@ -83,3 +83,23 @@ func (pdl *ProportionDataLoaderRedis) Load(*Stat) (StatData, error) {
 func (pdl *ProportionDataLoaderRedis) String() string {
 	return pdl.RedisKeyMaker.String()
 }
+
+type ProportionDataLoaderMemory struct {
+	MemoryKeyMaker
+}
+
+func (pdl *ProportionDataLoaderMemory) FetchData() ([]int, error) {
+	if stored, ok := pdl.Store.get(pdl.MakeKey()).([]int); ok && len(stored) >= 2 {
+		return []int{stored[0], stored[1]}, nil
+	}
+	return []int{0, 0}, nil
+}
+
+func (pdl *ProportionDataLoaderMemory) Load(*Stat) (StatData, error) {
+	data, _ := pdl.FetchData()
+	return &ProportionData{Current: data[0], Total: data[1], dataLoader: pdl}, nil
+}
+
+func (pdl *ProportionDataLoaderMemory) String() string {
+	return pdl.RedisKeyMaker.String()
+}
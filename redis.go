@@ -1,55 +1,254 @@
 package arithmospora
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
 
 type RedisConfig struct {
-	Server      string
-	Password    string
-	DB          int
-	MaxIdle     int
-	IdleTimeout int
+	Server           string
+	Username         string
+	Password         string
+	DB               int
+	MaxIdle          int
+	IdleTimeout      int
+	ConnectTimeoutMs int
+	ReadTimeoutMs    int
+	WriteTimeoutMs   int
+	TLS              bool
+	TLSCA            string
+	TLSCert          string
+	TLSKey           string
+	TLSServerName    string
+	TLSSkipVerify    bool
+	Sentinels        []string
+	SentinelMaster   string
+	SentinelUsername string
+	SentinelPassword string
 }
 
-var redisConfig = RedisConfig{Server: ":6379", Password: "", DB: 1, MaxIdle: 3, IdleTimeout: 240}
-var redisPool *redis.Pool
+// defaultRedisConfig is used in place of an empty redis section
+var defaultRedisConfig = RedisConfig{Server: ":6379", Password: "", DB: 1, MaxIdle: 3, IdleTimeout: 240}
 
-func SetRedisConfig(config RedisConfig) {
-	if config != (RedisConfig{}) {
-		redisConfig = config
+// orDefault returns the config, or the default config if none is set
+func (rc RedisConfig) orDefault() RedisConfig {
+	if reflect.DeepEqual(rc, RedisConfig{}) {
+		return defaultRedisConfig
 	}
+	return rc
 }
 
-func RedisPool() *redis.Pool {
-	if redisPool == nil {
-		redisPool = &redis.Pool{
-			MaxIdle:     redisConfig.MaxIdle,
-			IdleTimeout: time.Duration(redisConfig.IdleTimeout) * time.Second,
-			Dial: func() (redis.Conn, error) {
-				c, err := redis.Dial("tcp", redisConfig.Server)
-				if err != nil {
-					return nil, err
-				}
-				if redisConfig.Password != "" {
-					if _, err := c.Do("AUTH", redisConfig.Password); err != nil {
-						c.Close()
-						return nil, err
-					}
-				}
-				if _, err := c.Do("SELECT", redisConfig.DB); err != nil {
-					c.Close()
-					return nil, err
-				}
-				return c, nil
-			},
+// NewPool returns a pool of connections to the configured server, or the
+// default server if the config is empty. Connections are made as needed, so
+// errors such as a missing TLS certificate are returned when getting them
+func (rc RedisConfig) NewPool() *redis.Pool {
+	rc = rc.orDefault()
+	tlsConfig, tlsErr := rc.tlsConfig()
+	return &redis.Pool{
+		MaxIdle:     rc.MaxIdle,
+		IdleTimeout: time.Duration(rc.IdleTimeout) * time.Second,
+		Dial: func() (redis.Conn, error) {
+			if tlsErr != nil {
+				return nil, tlsErr
+			}
+			return rc.dial(tlsConfig)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			// After a Sentinel failover the old master may be demoted:
+			// check the role of connections which have been idle a while.
+			// Busier connections are discarded once a write is refused
+			if len(rc.Sentinels) == 0 || time.Since(t) < time.Minute {
+				return nil
+			}
+			return checkRedisRole(c, "master")
+		},
+	}
+}
+
+// tlsConfig builds the TLS configuration for connections, or returns nil if
+// TLS is not enabled
+func (rc RedisConfig) tlsConfig() (*tls.Config, error) {
+	if !rc.TLS {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{ServerName: rc.TLSServerName, InsecureSkipVerify: rc.TLSSkipVerify}
+	if rc.TLSCA != "" {
+		ca, err := ioutil.ReadFile(rc.TLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("redis tls_ca: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("redis tls_ca: no certificates found in %s", rc.TLSCA)
+		}
+	}
+	if rc.TLSCert != "" || rc.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(rc.TLSCert, rc.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("redis tls_cert/tls_key: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func (rc RedisConfig) dialOptions(tlsConfig *tls.Config) []redis.DialOption {
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(time.Duration(rc.ConnectTimeoutMs) * time.Millisecond),
+		redis.DialReadTimeout(time.Duration(rc.ReadTimeoutMs) * time.Millisecond),
+		redis.DialWriteTimeout(time.Duration(rc.WriteTimeoutMs) * time.Millisecond),
+	}
+	if tlsConfig != nil {
+		options = append(options, redis.DialUseTLS(true), redis.DialTLSConfig(tlsConfig))
+	}
+	return options
+}
+
+// dial connects to the configured server, or to the master discovered
+// through the configured sentinels, authenticating and selecting the
+// configured database
+func (rc RedisConfig) dial(tlsConfig *tls.Config) (redis.Conn, error) {
+	address := rc.Server
+	if len(rc.Sentinels) > 0 {
+		var err error
+		if address, err = rc.sentinelMasterAddr(tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	c, err := redis.Dial("tcp", address, rc.dialOptions(tlsConfig)...)
+	if err != nil {
+		return nil, err
+	}
+	if err := redisAuth(c, rc.Username, rc.Password); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if _, err := c.Do("SELECT", rc.DB); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if len(rc.Sentinels) > 0 {
+		if err := checkRedisRole(c, "master"); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return &sentinelConn{Conn: c}, nil
+	}
+	return c, nil
+}
+
+// errRedisDemoted is the error of a connection to a master which has since
+// been demoted
+var errRedisDemoted = fmt.Errorf("redis master demoted to replica")
+
+// sentinelConn is a connection to a master discovered through Sentinel. A
+// master demoted by a failover refuses writes with READONLY errors, upon
+// which the connection reports itself broken so that the pool discards it
+// and dials the new master, however recently the connection was used
+type sentinelConn struct {
+	redis.Conn
+	demoted bool
+}
+
+func (sc *sentinelConn) Err() error {
+	if sc.demoted {
+		return errRedisDemoted
+	}
+	return sc.Conn.Err()
+}
+
+func (sc *sentinelConn) check(reply interface{}, err error) (interface{}, error) {
+	if redisErr, ok := err.(redis.Error); ok && strings.HasPrefix(string(redisErr), "READONLY") {
+		sc.demoted = true
+	}
+	return reply, err
+}
+
+func (sc *sentinelConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	return sc.check(sc.Conn.Do(commandName, args...))
+}
+
+func (sc *sentinelConn) Receive() (interface{}, error) {
+	return sc.check(sc.Conn.Receive())
+}
+
+func (sc *sentinelConn) DoWithTimeout(timeout time.Duration, commandName string, args ...interface{}) (interface{}, error) {
+	return sc.check(redis.DoWithTimeout(sc.Conn, timeout, commandName, args...))
+}
+
+func (sc *sentinelConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	return sc.check(redis.ReceiveWithTimeout(sc.Conn, timeout))
+}
+
+// sentinelMasterAddr asks each sentinel in turn for the address of the
+// configured master
+func (rc RedisConfig) sentinelMasterAddr(tlsConfig *tls.Config) (string, error) {
+	var lastErr error
+	for _, sentinel := range rc.Sentinels {
+		addr, err := func() (string, error) {
+			c, err := redis.Dial("tcp", sentinel, rc.dialOptions(tlsConfig)...)
+			if err != nil {
+				return "", err
+			}
+			defer c.Close()
+			if err := redisAuth(c, rc.SentinelUsername, rc.SentinelPassword); err != nil {
+				return "", err
+			}
+			master, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", rc.SentinelMaster))
+			if err != nil {
+				return "", err
+			}
+			if len(master) != 2 {
+				return "", fmt.Errorf("unexpected reply %v", master)
+			}
+			return net.JoinHostPort(master[0], master[1]), nil
+		}()
+		if err == nil {
+			return addr, nil
 		}
+		lastErr = fmt.Errorf("sentinel %s: %v", sentinel, err)
 	}
-	return redisPool
+	return "", fmt.Errorf("no sentinel provided master %s: %v", rc.SentinelMaster, lastErr)
+}
+
+// redisAuth authenticates with a password, or with a username and password
+// for Redis 6 ACL users. No attempt to auth is made if password is empty
+func redisAuth(c redis.Conn, username string, password string) error {
+	if password == "" {
+		return nil
+	}
+	var err error
+	if username != "" {
+		_, err = c.Do("AUTH", username, password)
+	} else {
+		_, err = c.Do("AUTH", password)
+	}
+	return err
+}
+
+func checkRedisRole(c redis.Conn, expected string) error {
+	role, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(role) == 0 {
+		return fmt.Errorf("empty ROLE reply")
+	}
+	if actual, _ := redis.String(role[0], nil); actual != expected {
+		return fmt.Errorf("redis role is %s, expected %s", actual, expected)
+	}
+	return nil
 }
 
 func makeKey(elements ...string) string {
@@ -76,17 +275,24 @@ func (rkb *RedisKeyMaker) String() string {
 	return rkb.RedisPrefix
 }
 
+// RedisPoolKeyMaker makes the keys of a stat held in Redis, getting
+// connections to Redis from Pool
+type RedisPoolKeyMaker struct {
+	RedisKeyMaker
+	Pool *redis.Pool
+}
+
 type RedisDataLoader interface {
 	StatDataLoader
 	SetRedisPrefix(string)
 }
 
 type RedisDataPointLoader struct {
-	RedisKeyMaker
+	RedisPoolKeyMaker
 }
 
 func (rdpl *RedisDataPointLoader) DataPointNames() ([]string, error) {
-	conn := RedisPool().Get()
+	conn := rdpl.Pool.Get()
 	defer conn.Close()
 
 	return redis.Strings(conn.Do("SMEMBERS", rdpl.MakeKey("datapoints")))
@@ -97,34 +303,303 @@ func (rdpl *RedisDataPointLoader) NewDataLoader(sdl StatDataLoader, dpName strin
 	if val.Kind() == reflect.Ptr {
 		val = reflect.Indirect(val)
 	}
-	rdl := reflect.New(val.Type()).Interface().(RedisDataLoader)
+	// Copy the stat's loader to keep its pool
+	copied := reflect.New(val.Type())
+	copied.Elem().Set(val)
+	rdl := copied.Interface().(RedisDataLoader)
 	rdl.SetRedisPrefix(rdpl.MakeKey("datapoints", dpName))
 	return rdl
 }
 
 func (rdpl *RedisDataPointLoader) NewDataPointLoader(dpName string) StatDataPointLoader {
-	return &RedisDataPointLoader{RedisKeyMaker{RedisPrefix: rdpl.MakeKey("datapoints", dpName)}}
+	return &RedisDataPointLoader{RedisPoolKeyMaker{RedisKeyMaker{RedisPrefix: rdpl.MakeKey("datapoints", dpName)}, rdpl.Pool}}
 }
 
+// Pub/sub subscriptions reconnect with exponential backoff between these
+// bounds, and ping the server at the health check interval to detect dead
+// connections
+const (
+	subscribeMinBackoff  = 100 * time.Millisecond
+	subscribeMaxBackoff  = 30 * time.Second
+	subscribeHealthCheck = 30 * time.Second
+)
+
 type RedisUpdateListener struct {
-	RedisKeyMaker
+	RedisPoolKeyMaker
+	Subscriber         *RedisSubscriber
+	KeyspaceSubscriber *RedisSubscriber
 }
 
-func (rul *RedisUpdateListener) Subscribe(updated chan<- bool) {
-	go func() {
-		for {
-			c := RedisPool().Get()
-			psc := redis.PubSubConn{Conn: c}
-			defer psc.Close()
+// Subscribe listens for messages on the stat's updates channel through the
+// listener's shared subscriber, or a subscriber of its own to just that
+// channel if none is set. If a keyspace subscriber is set, changes to the
+// stat's keys are also listened for
+func (rul *RedisUpdateListener) Subscribe(ctx context.Context, updated chan<- bool, errors chan<- error) {
+	channel := rul.MakeKey("updates")
+	if rul.Subscriber == nil {
+		rul.Subscriber = &RedisSubscriber{Pattern: escapeRedisPattern(channel), Pool: rul.Pool}
+	}
+	rul.Subscriber.Subscribe(ctx, channel, updated, errors)
+	if rul.KeyspaceSubscriber != nil {
+		rul.KeyspaceSubscriber.Subscribe(ctx, rul.RedisPrefix, updated, errors)
+	}
+}
+
+// RedisSubscriber multiplexes the pub/sub subscriptions of many stats over a
+// single connection: it pattern subscribes to Pattern, and dispatches each
+// message to the listeners of the channel it was published to. Lost
+// connections are retried with backoff, reporting their state on the
+// listeners' error channels, and once resubscribed every listener is sent
+// false to signal that updates may have been missed. The subscriber runs
+// while it has listeners, closing its connection once the last has gone.
+//
+// Keyspace subscribers instead receive keyspace notifications, and dispatch
+// them to the listeners of the stat owning the changed key: listeners are
+// registered by stat key prefix, and own the <prefix>:data and
+// <prefix>:datapoints keys and the keys under them.
+type RedisSubscriber struct {
+	Pattern   string
+	Keyspace  bool
+	Pool      *redis.Pool
+	mu        sync.Mutex
+	listeners map[string][]*redisListener
+	stop      context.CancelFunc
+}
+
+// redisListener is a subscription to a channel, which ends once done
+type redisListener struct {
+	updated chan<- bool
+	errors  chan<- error
+	done    <-chan struct{}
+}
+
+// NewRedisSubscriber returns a subscriber for all the updates channels under
+// the given Redis prefix, subscribing on a connection from pool
+func NewRedisSubscriber(pool *redis.Pool, prefix string) *RedisSubscriber {
+	return &RedisSubscriber{Pattern: makeKey(prefix, "*", "updates"), Pool: pool}
+}
+
+// escapeRedisPattern returns a pattern matching only the given channel
+func escapeRedisPattern(channel string) string {
+	var escaped strings.Builder
+	for _, r := range channel {
+		if strings.ContainsRune(`*?[]\`, r) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
+
+// NewRedisKeyspaceSubscriber returns a subscriber for keyspace notifications
+// of all keys under the given Redis prefix. Redis must be configured to send
+// keyspace notifications with notify-keyspace-events, e.g. "KA"
+func NewRedisKeyspaceSubscriber(pool *redis.Pool, db int, prefix string) *RedisSubscriber {
+	return &RedisSubscriber{Pattern: fmt.Sprintf("__keyspace@%d__:%s", db, makeKey(prefix, "*")), Keyspace: true, Pool: pool}
+}
+
+// Subscribe registers updated to receive the messages published to channel,
+// which must match the subscriber's pattern, until ctx is done, starting the
+// subscriber if not already running
+func (rs *RedisSubscriber) Subscribe(ctx context.Context, channel string, updated chan<- bool, errors chan<- error) {
+	listener := &redisListener{updated, errors, ctx.Done()}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.listeners == nil {
+		rs.listeners = make(map[string][]*redisListener)
+	}
+	rs.listeners[channel] = append(rs.listeners[channel], listener)
+
+	if rs.stop == nil {
+		var runCtx context.Context
+		runCtx, rs.stop = context.WithCancel(context.Background())
+		go rs.run(runCtx)
+	}
+
+	if listener.done != nil {
+		go func() {
+			<-listener.done
+			rs.unsubscribe(channel, listener)
+		}()
+	}
+}
+
+// unsubscribe removes a listener, stopping the subscriber if none remain
+func (rs *RedisSubscriber) unsubscribe(channel string, listener *redisListener) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for i, l := range rs.listeners[channel] {
+		if l == listener {
+			rs.listeners[channel] = append(rs.listeners[channel][:i:i], rs.listeners[channel][i+1:]...)
+			break
+		}
+	}
+	if len(rs.listeners[channel]) == 0 {
+		delete(rs.listeners, channel)
+	}
+	if len(rs.listeners) == 0 && rs.stop != nil {
+		rs.stop()
+		rs.stop = nil
+	}
+}
+
+// dispatch sends value to the listeners of channel, or all listeners if
+// channel is empty. Updates are a level signal, so an update is dropped if
+// one is already pending rather than holding up the other listeners, but a
+// false value, signalling updates may have been missed, is always delivered
+func (rs *RedisSubscriber) dispatch(channel string, value bool) {
+	rs.mu.Lock()
+	var listeners []*redisListener
+	if channel == "" {
+		for _, channelListeners := range rs.listeners {
+			listeners = append(listeners, channelListeners...)
+		}
+	} else if rs.Keyspace {
+		listeners = append(listeners, rs.listeners[rs.keyOwner(channel)]...)
+	} else {
+		listeners = append(listeners, rs.listeners[channel]...)
+	}
+	rs.mu.Unlock()
+
+	for _, listener := range listeners {
+		if value {
+			select {
+			case listener.updated <- value:
+			default:
+			}
+			continue
+		}
+		select {
+		case listener.updated <- value:
+		case <-listener.done:
+		}
+	}
+}
+
+// keyOwner returns the prefix of the registered stat owning the key of a
+// keyspace notification channel, or an empty string if there is none. Must
+// be called with the lock held
+func (rs *RedisSubscriber) keyOwner(channel string) string {
+	key := channel[strings.Index(channel, ":")+1:]
+	elements := strings.Split(key, ":")
+	for i := len(elements) - 1; i > 0; i-- {
+		prefix := strings.Join(elements[:i], ":")
+		if _, ok := rs.listeners[prefix]; ok {
+			if owned := elements[i]; owned == "data" || owned == "datapoints" {
+				return prefix
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+// report sends err once to each distinct error channel of the listeners
+func (rs *RedisSubscriber) report(err error) {
+	rs.mu.Lock()
+	var listeners []*redisListener
+	reported := make(map[chan<- error]bool)
+	for _, channelListeners := range rs.listeners {
+		for _, listener := range channelListeners {
+			if !reported[listener.errors] {
+				reported[listener.errors] = true
+				listeners = append(listeners, listener)
+			}
+		}
+	}
+	rs.mu.Unlock()
+
+	for _, listener := range listeners {
+		select {
+		case listener.errors <- err:
+		case <-listener.done:
+		}
+	}
+}
 
-			psc.Subscribe(rul.MakeKey("updates"))
+func (rs *RedisSubscriber) run(ctx context.Context) {
+	backoff := subscribeMinBackoff
+	subscribed := false
+	for {
+		err := rs.receive(ctx, func() {
+			if subscribed {
+				rs.report(fmt.Errorf("%s: resubscribed, resyncing", rs.Pattern))
+				rs.dispatch("", false)
+			}
+			subscribed = true
+			backoff = subscribeMinBackoff
+		})
+		if ctx.Err() != nil {
+			return
+		}
 
-			for c.Err() == nil {
-				switch psc.Receive().(type) {
-				case redis.Message:
-					updated <- true
+		rs.report(fmt.Errorf("%s: subscription lost: %v; retrying in %v", rs.Pattern, err, backoff))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > subscribeMaxBackoff {
+			backoff = subscribeMaxBackoff
+		}
+	}
+}
+
+// receive pattern subscribes on a new connection, calling subscribed once
+// the subscription is confirmed and dispatching messages until the
+// connection fails or ctx is done
+func (rs *RedisSubscriber) receive(ctx context.Context, subscribed func()) error {
+	psc := redis.PubSubConn{Conn: rs.Pool.Get()}
+	defer psc.Close()
+
+	if err := psc.PSubscribe(rs.Pattern); err != nil {
+		return err
+	}
+
+	// The health check must finish writing to the connection before it is
+	// closed
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	defer wg.Wait()
+	defer close(done)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(subscribeHealthCheck)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := psc.Ping(""); err != nil {
+					return
+				}
+			case <-ctx.Done():
+				// Unsubscribing ends the receive loop below, as does closing
+				// the connection if unsubscribing fails
+				if err := psc.PUnsubscribe(); err != nil {
+					psc.Close()
 				}
+				return
+			case <-done:
+				return
 			}
 		}
 	}()
+
+	for {
+		switch v := psc.ReceiveWithTimeout(2 * subscribeHealthCheck).(type) {
+		case redis.PMessage:
+			rs.dispatch(v.Channel, true)
+		case redis.Subscription:
+			switch {
+			case v.Kind == "psubscribe":
+				subscribed()
+			case v.Kind == "punsubscribe" && v.Count == 0:
+				return nil
+			}
+		case error:
+			return v
+		}
+	}
 }
@@ -0,0 +1,432 @@
+package arithmospora
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// fakeRedis is a Redis server supporting just enough to test subscribers
+// and connections: PSUBSCRIBE, PUNSUBSCRIBE, PUBLISH, PING, AUTH, ROLE, SET
+// and SENTINEL get-master-addr-by-name. Other commands are answered OK. If a
+// password is set, commands other than AUTH are refused until authenticated.
+// A role other than master refuses SET, and a fake sentinel answers with the
+// address of master
+type fakeRedis struct {
+	listener net.Listener
+	mu       sync.Mutex
+	patterns map[net.Conn][]string
+	username string
+	password string
+	role     string
+	master   *fakeRedis
+	commands []string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveFakeRedis(t, listener)
+}
+
+func serveFakeRedis(t *testing.T, listener net.Listener) *fakeRedis {
+	fr := &fakeRedis{listener: listener, patterns: make(map[net.Conn][]string), role: "master"}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(conn)
+		}
+	}()
+	return fr
+}
+
+func (fr *fakeRedis) addr() string {
+	return fr.listener.Addr().String()
+}
+
+func (fr *fakeRedis) pool() *redis.Pool {
+	return RedisConfig{Server: fr.addr(), MaxIdle: 1}.NewPool()
+}
+
+func (fr *fakeRedis) serve(conn net.Conn) {
+	defer func() {
+		fr.mu.Lock()
+		delete(fr.patterns, conn)
+		fr.mu.Unlock()
+		conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	authenticated := false
+	for {
+		command, err := readRESPCommand(reader)
+		if err != nil {
+			return
+		}
+		fr.mu.Lock()
+		fr.commands = append(fr.commands, strings.Join(command, " "))
+		switch {
+		case command[0] == "AUTH":
+			username, password := "default", command[len(command)-1]
+			if len(command) == 3 {
+				username = command[1]
+			}
+			if fr.username != "" && username != fr.username || password != fr.password {
+				fmt.Fprintf(conn, "-WRONGPASS invalid username-password pair\r\n")
+			} else {
+				authenticated = true
+				fmt.Fprintf(conn, "+OK\r\n")
+			}
+		case fr.password != "" && !authenticated:
+			fmt.Fprintf(conn, "-NOAUTH Authentication required.\r\n")
+		case command[0] == "PSUBSCRIBE":
+			for _, pattern := range command[1:] {
+				fr.patterns[conn] = append(fr.patterns[conn], pattern)
+				fmt.Fprintf(conn, "*3\r\n$10\r\npsubscribe\r\n%s:%d\r\n", respBulk(pattern), len(fr.patterns[conn]))
+			}
+		case command[0] == "PUNSUBSCRIBE":
+			patterns := fr.patterns[conn]
+			delete(fr.patterns, conn)
+			if len(patterns) == 0 {
+				fmt.Fprintf(conn, "*3\r\n$12\r\npunsubscribe\r\n$-1\r\n:0\r\n")
+			}
+			for i, pattern := range patterns {
+				fmt.Fprintf(conn, "*3\r\n$12\r\npunsubscribe\r\n%s:%d\r\n", respBulk(pattern), len(patterns)-i-1)
+			}
+		case command[0] == "PUBLISH":
+			receivers := 0
+			for subscriber, patterns := range fr.patterns {
+				for _, pattern := range patterns {
+					if matched, _ := path.Match(pattern, command[1]); matched {
+						fmt.Fprintf(subscriber, "*4\r\n$8\r\npmessage\r\n%s%s%s", respBulk(pattern), respBulk(command[1]), respBulk(command[2]))
+						receivers++
+					}
+				}
+			}
+			fmt.Fprintf(conn, ":%d\r\n", receivers)
+		case command[0] == "PING":
+			if _, ok := fr.patterns[conn]; ok {
+				fmt.Fprintf(conn, "*2\r\n$4\r\npong\r\n$0\r\n\r\n")
+			} else {
+				fmt.Fprintf(conn, "+PONG\r\n")
+			}
+		case command[0] == "ROLE":
+			fmt.Fprintf(conn, "*1\r\n%s", respBulk(fr.role))
+		case command[0] == "SET" && fr.role != "master":
+			fmt.Fprintf(conn, "-READONLY You can't write against a read only replica.\r\n")
+		case command[0] == "SENTINEL" && fr.master != nil:
+			host, port, _ := net.SplitHostPort(fr.master.addr())
+			fmt.Fprintf(conn, "*2\r\n%s%s", respBulk(host), respBulk(port))
+		default:
+			fmt.Fprintf(conn, "+OK\r\n")
+		}
+		fr.mu.Unlock()
+	}
+}
+
+// update changes the server's settings, e.g. its role
+func (fr *fakeRedis) update(change func()) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	change()
+}
+
+// received returns the commands the server has received, with their
+// arguments, beginning with the given prefix
+func (fr *fakeRedis) received(prefix string) (commands []string) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	for _, command := range fr.commands {
+		if strings.HasPrefix(command, prefix) {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+// subscribed waits until count patterns are subscribed to
+func (fr *fakeRedis) subscribed(t *testing.T, count int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		fr.mu.Lock()
+		subscribed := 0
+		for _, patterns := range fr.patterns {
+			subscribed += len(patterns)
+		}
+		fr.mu.Unlock()
+		if subscribed == count {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d patterns subscribed, want %d", subscribed, count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func respBulk(value string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+}
+
+func readRESPCommand(reader *bufio.Reader) ([]string, error) {
+	var count int
+	if _, err := fmt.Fscanf(reader, "*%d\r\n", &count); err != nil {
+		return nil, err
+	}
+	command := make([]string, count)
+	for i := range command {
+		var length int
+		if _, err := fmt.Fscanf(reader, "$%d\r\n", &length); err != nil {
+			return nil, err
+		}
+		value := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, value); err != nil {
+			return nil, err
+		}
+		command[i] = string(value[:length])
+	}
+	return command, nil
+}
+
+func publish(t *testing.T, pool *redis.Pool, channel string) {
+	t.Helper()
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PUBLISH", channel, strconv.FormatInt(time.Now().Unix(), 10)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisUpdateListenerOwnSubscriber(t *testing.T) {
+	fr := newFakeRedis(t)
+	pool := fr.pool()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener := &RedisUpdateListener{RedisPoolKeyMaker: RedisPoolKeyMaker{RedisKeyMaker{RedisPrefix: "election:stats:total"}, pool}}
+	updated := make(chan bool, 1)
+	listener.Subscribe(ctx, updated, make(chan error, 10))
+	fr.subscribed(t, 1)
+
+	publish(t, pool, "election:stats:other:updates")
+	publish(t, pool, "election:stats:total:updates")
+	select {
+	case update := <-updated:
+		if !update {
+			t.Fatal("updated sent false, want true")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no update received")
+	}
+	select {
+	case <-updated:
+		t.Fatal("update received for another stat's channel")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRedisSubscriberSlowListener(t *testing.T) {
+	fr := newFakeRedis(t)
+	pool := fr.pool()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	subscriber := NewRedisSubscriber(pool, "election:stats")
+	busy, updated := make(chan bool, 1), make(chan bool, 1)
+	errors := make(chan error, 10)
+	subscriber.Subscribe(ctx, "election:stats:busy:updates", busy, errors)
+	subscriber.Subscribe(ctx, "election:stats:total:updates", updated, errors)
+	fr.subscribed(t, 1)
+
+	// The busy listener never receives, which must not hold up the other
+	for i := 0; i < 5; i++ {
+		publish(t, pool, "election:stats:busy:updates")
+	}
+	publish(t, pool, "election:stats:total:updates")
+	select {
+	case <-updated:
+	case <-time.After(2 * time.Second):
+		t.Fatal("update held up by a listener which is not receiving")
+	}
+	if len(busy) != 1 {
+		t.Fatalf("busy listener has %d pending updates, want 1", len(busy))
+	}
+}
+
+func TestRedisPoolAuth(t *testing.T) {
+	tests := []struct {
+		name           string
+		serverUsername string
+		username       string
+		password       string
+		auth           string
+		wantErr        bool
+	}{
+		{"password", "", "", "secret", "AUTH secret", false},
+		{"ACL user", "alice", "alice", "secret", "AUTH alice secret", false},
+		{"wrong password", "alice", "alice", "wrong", "AUTH alice wrong", true},
+		{"no credentials", "", "", "", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fr := newFakeRedis(t)
+			fr.update(func() { fr.username, fr.password = test.serverUsername, "secret" })
+			pool := RedisConfig{Server: fr.addr(), Username: test.username, Password: test.password, MaxIdle: 1}.NewPool()
+			defer pool.Close()
+			conn := pool.Get()
+			defer conn.Close()
+			if _, err := conn.Do("PING"); (err != nil) != test.wantErr {
+				t.Errorf("PING error %v, want error %v", err, test.wantErr)
+			}
+			if auth := fr.received("AUTH"); test.auth != "" && (len(auth) != 1 || auth[0] != test.auth) {
+				t.Errorf("received %q, want %q", auth, test.auth)
+			}
+		})
+	}
+}
+
+// testCertificate returns a self-signed certificate for 127.0.0.1, and the
+// path of a file holding it for use as a CA
+func testCertificate(t *testing.T) (tls.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake redis"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, caFile
+}
+
+func TestRedisPoolTLS(t *testing.T) {
+	cert, caFile := testCertificate(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := serveFakeRedis(t, listener)
+
+	tests := []struct {
+		name    string
+		config  RedisConfig
+		wantErr bool
+	}{
+		{"trusted CA", RedisConfig{Server: fr.addr(), TLS: true, TLSCA: caFile}, false},
+		{"system CAs", RedisConfig{Server: fr.addr(), TLS: true}, true},
+		{"verification skipped", RedisConfig{Server: fr.addr(), TLS: true, TLSSkipVerify: true}, false},
+		{"missing CA file", RedisConfig{Server: fr.addr(), TLS: true, TLSCA: caFile + ".missing"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := test.config.NewPool()
+			defer pool.Close()
+			conn := pool.Get()
+			defer conn.Close()
+			reply, err := redis.String(conn.Do("PING"))
+			if (err != nil) != test.wantErr || (err == nil && reply != "PONG") {
+				t.Errorf("PING replied %q, error %v, want error %v", reply, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestRedisSentinelFailover(t *testing.T) {
+	oldMaster, newMaster, sentinel := newFakeRedis(t), newFakeRedis(t), newFakeRedis(t)
+	for _, master := range []*fakeRedis{oldMaster, newMaster} {
+		master := master
+		master.update(func() { master.password = "secret" })
+	}
+	sentinel.update(func() { sentinel.password, sentinel.master = "sentinel-secret", oldMaster })
+
+	// Sentinels are asked in turn, so one which is down is skipped
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+
+	pool := RedisConfig{
+		Password:         "secret",
+		Sentinels:        []string{down.Addr().String(), sentinel.addr()},
+		SentinelMaster:   "election",
+		SentinelPassword: "sentinel-secret",
+		MaxIdle:          1,
+	}.NewPool()
+	defer pool.Close()
+	set := func() error {
+		conn := pool.Get()
+		defer conn.Close()
+		_, err := conn.Do("SET", "election:stats:total:current", 1)
+		return err
+	}
+
+	if err := set(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(oldMaster.received("SET")); got != 1 {
+		t.Fatalf("master received %d writes, want 1", got)
+	}
+	if got := sentinel.received("SENTINEL"); len(got) != 1 || got[0] != "SENTINEL get-master-addr-by-name election" {
+		t.Fatalf("sentinel received %q, want a master lookup", got)
+	}
+
+	// After failover the busy connection to the old master is refused its
+	// next write and discarded, so the write after goes to the new master
+	oldMaster.update(func() { oldMaster.role = "slave" })
+	sentinel.update(func() { sentinel.master = newMaster })
+	if err := set(); err == nil {
+		t.Fatal("write to demoted master succeeded")
+	}
+	if err := set(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(newMaster.received("SET")); got != 1 {
+		t.Errorf("new master received %d writes, want 1", got)
+	}
+	if got := len(sentinel.received("SENTINEL")); got != 2 {
+		t.Errorf("sentinel received %d lookups, want 2", got)
+	}
+}
@@ -0,0 +1,61 @@
+package arithmospora
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// RelayedData is stat data received already encoded from another server, as
+// by a cluster follower, and served as received
+type RelayedData struct {
+	raw json.RawMessage
+}
+
+func (rd *RelayedData) Refresh() error {
+	return nil
+}
+
+func (rd *RelayedData) MarshalJSON() ([]byte, error) {
+	if len(rd.raw) == 0 {
+		return []byte("null"), nil
+	}
+	return rd.raw, nil
+}
+
+func (rd *RelayedData) String() string {
+	return string(rd.raw)
+}
+
+// Relay replaces the stat's data and datapoints with those of the encoded
+// stat, in the form sent to clients in stats:* messages
+func (s *Stat) Relay(payload json.RawMessage) error {
+	var encoded struct {
+		Data       json.RawMessage            `json:"data"`
+		DataPoints map[string]json.RawMessage `json:"dataPoints"`
+	}
+	if err := json.Unmarshal(payload, &encoded); err != nil {
+		return fmt.Errorf("relaying stat %s: %v", s.Name, err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	dataPoints := make(map[string]*Stat, len(encoded.DataPoints))
+	dataPointNames := make([]string, 0, len(encoded.DataPoints))
+	for dpName, dpPayload := range encoded.DataPoints {
+		dp := s.dataPoints[dpName]
+		if dp == nil {
+			dp = &Stat{Name: dpName, Depth: s.Depth + 1, Clock: s.Clock}
+		}
+		if err := dp.Relay(dpPayload); err != nil {
+			return err
+		}
+		dataPoints[dpName] = dp
+		dataPointNames = append(dataPointNames, dpName)
+	}
+	sort.Strings(dataPointNames)
+	s.data = &RelayedData{encoded.Data}
+	s.dataPoints = dataPoints
+	s.dataPointNames = dataPointNames
+	return nil
+}
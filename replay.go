@@ -0,0 +1,254 @@
+package arithmospora
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// RecordedRefresh is a stat's state following a refresh, as recorded by
+// Source.Record: one JSON object per line
+type RecordedRefresh struct {
+	Time  time.Time    `json:"time"`
+	Group string       `json:"group"`
+	Key   string       `json:"key"`
+	Stat  SnapshotStat `json:"stat"`
+}
+
+// Record writes the state of each of the source's stats to w as a recorded
+// refresh, then writes each stat again whenever it is refreshed, until ctx is
+// done. The source must already be published so that its stats are loaded
+func (s *Source) Record(ctx context.Context, w io.Writer, errors chan<- error) {
+	var mu sync.Mutex
+	encoder := json.NewEncoder(w)
+	clock := clockOrSystem(s.Clock)
+	record := func(statGroup string, statKey string, stat *Stat) {
+		mu.Lock()
+		defer mu.Unlock()
+		err := encoder.Encode(struct {
+			Time  time.Time `json:"time"`
+			Group string    `json:"group"`
+			Key   string    `json:"key"`
+			Stat  *Stat     `json:"stat"`
+		}{clock.Now(), statGroup, statKey, stat})
+		if err != nil {
+			select {
+			case errors <- fmt.Errorf("recording %s:%s: %v", statGroup, statKey, err):
+			case <-ctx.Done():
+			}
+		}
+	}
+
+	for sg, stats := range s.Stats {
+		statGroup := sg
+		for sk, st := range stats {
+			statKey := sk
+			stat := st
+			record(statGroup, statKey, stat)
+			listener := stat.Listen(ctx, "record")
+			go func() {
+				for {
+					select {
+					case <-listener.Ready():
+						if _, ok := listener.Next(); ok {
+							record(statGroup, statKey, stat)
+						}
+					case <-listener.Done():
+						return
+					}
+				}
+			}()
+		}
+	}
+}
+
+// ReadRecording reads the refreshes written by Source.Record
+func ReadRecording(r io.Reader) (records []RecordedRefresh, err error) {
+	decoder := json.NewDecoder(r)
+	for {
+		var record RecordedRefresh
+		if err := decoder.Decode(&record); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("recorded refresh %v: %v", len(records)+1, err)
+		}
+		records = append(records, record)
+	}
+}
+
+// ReplayClock is a clock which only advances when set, so that a replayed
+// source sees the times at which refreshes were recorded. Timers fire once
+// the clock is set past their expiry
+type ReplayClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []replayTimer
+}
+
+type replayTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func NewReplayClock(start time.Time) *ReplayClock {
+	return &ReplayClock{now: start}
+}
+
+func (rc *ReplayClock) Now() time.Time {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.now
+}
+
+func (rc *ReplayClock) After(d time.Duration) <-chan time.Time {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- rc.now
+	} else {
+		rc.timers = append(rc.timers, replayTimer{rc.now.Add(d), c})
+	}
+	return c
+}
+
+// Set advances the clock to t, firing the timers which have expired
+func (rc *ReplayClock) Set(t time.Time) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if t.After(rc.now) {
+		rc.now = t
+	}
+	pending := rc.timers[:0]
+	for _, timer := range rc.timers {
+		if timer.at.After(rc.now) {
+			pending = append(pending, timer)
+		} else {
+			timer.c <- rc.now
+		}
+	}
+	rc.timers = pending
+}
+
+// ReplaySourceConfig returns the config of a source for replaying recorded
+// refreshes: stats are loaded from the source's memory store, into which the
+// replayer writes each recorded refresh, and the source is not live, as the
+// replayer refreshes stats itself. Replayed refreshes are not recorded again
+func ReplaySourceConfig(sourceConfig SourceConfig) SourceConfig {
+	sourceConfig = sourceConfig.WithLoaderType("memory")
+	sourceConfig.IsLive = false
+	sourceConfig.RecordFile = ""
+	return sourceConfig
+}
+
+// Replayer plays recorded refreshes back through a source made from a replay
+// source config with a replay clock. Refreshes are replayed at their
+// original pace divided by Speed, or one at a time as Step receives if Speed
+// is zero. Replayed stats notify their listeners as usual, so updates are
+// broadcast to clients and milestones fire as they did originally
+type Replayer struct {
+	Source       *Source
+	SourceConfig SourceConfig
+	Clock        *ReplayClock
+	Speed        float64
+	Step         <-chan bool
+	records      []RecordedRefresh
+	statConfigs  map[string]StatConfig
+}
+
+func NewReplayer(source *Source, sourceConfig SourceConfig, clock *ReplayClock, records []RecordedRefresh) *Replayer {
+	replayer := &Replayer{
+		Source:       source,
+		SourceConfig: sourceConfig,
+		Clock:        clock,
+		Speed:        1,
+		records:      records,
+		statConfigs:  make(map[string]StatConfig),
+	}
+	for group, statConfigs := range sourceConfig.GroupedStatConfigs() {
+		for _, statConfig := range statConfigs {
+			replayer.statConfigs[group+":"+statConfig.Key()] = statConfig
+		}
+	}
+	return replayer
+}
+
+// Preload stores the first recorded refresh of each stat, i.e. its state as
+// recording began, and sets the clock to the start of the recording. Call
+// before publishing the source so that milestones achieved before recording
+// began do not fire again
+func (r *Replayer) Preload() error {
+	if len(r.records) == 0 {
+		return nil
+	}
+	r.Clock.Set(r.records[0].Time)
+	stored := make(map[string]bool)
+	remaining := r.records[:0:0]
+	for _, record := range r.records {
+		if stored[record.Group+":"+record.Key] {
+			remaining = append(remaining, record)
+			continue
+		}
+		stored[record.Group+":"+record.Key] = true
+		if _, err := r.store(record); err != nil {
+			return err
+		}
+	}
+	r.records = remaining
+	return nil
+}
+
+func (r *Replayer) store(record RecordedRefresh) (*Stat, error) {
+	statConfig, ok := r.statConfigs[record.Group+":"+record.Key]
+	stat := r.Source.Stats[record.Group][record.Key]
+	if !ok || stat == nil {
+		return nil, fmt.Errorf("recorded stat %s:%s not found in source %s", record.Group, record.Key, r.Source.Name)
+	}
+	keyMaker := statConfig.KeyMaker(r.SourceConfig.RedisPrefix)
+	record.Stat.Store(r.Source.MemoryStore, keyMaker.RedisPrefix, statConfig.DataType, statConfig.Fields)
+	return stat, nil
+}
+
+// Replay plays back the recorded refreshes, returning once all have been
+// replayed or ctx is done
+func (r *Replayer) Replay(ctx context.Context, errors chan<- error) {
+	previous := r.Clock.Now()
+	for _, record := range r.records {
+		var (
+			next <-chan time.Time
+			step <-chan bool
+		)
+		if r.Speed > 0 {
+			next = time.After(time.Duration(float64(record.Time.Sub(previous)) / r.Speed))
+			previous = record.Time
+		} else {
+			step = r.Step
+		}
+		select {
+		case <-next:
+		case <-step:
+		case <-ctx.Done():
+			return
+		}
+
+		r.Clock.Set(record.Time)
+		stat, err := r.store(record)
+		if err == nil {
+			if err = stat.Backfill(); err != nil {
+				err = fmt.Errorf("%v replayed Stat.refresh(): %v", stat.Name, err)
+			}
+		}
+		if err != nil {
+			select {
+			case errors <- err:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		stat.NotifyListeners(StatEvent{Full: true})
+	}
+}
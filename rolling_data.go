@@ -77,11 +77,11 @@ func (rd *RollingData) MilestoneValue(field string) float64 {
 }
 
 type RollingDataLoaderRedis struct {
-	RedisKeyMaker
+	RedisPoolKeyMaker
 }
 
 func (rdl *RollingDataLoaderRedis) FetchData() ([]int, error) {
-	conn := RedisPool().Get()
+	conn := rdl.Pool.Get()
 	defer conn.Close()
 
 	return redis.Ints(conn.Do("HMGET", rdl.MakeKey("data"), "current", "total", "peak"))
@@ -99,3 +99,23 @@ func (rdl *RollingDataLoaderRedis) Load(*Stat) (StatData, error) {
 func (rdl *RollingDataLoaderRedis) String() string {
 	return rdl.RedisKeyMaker.String()
 }
+
+type RollingDataLoaderMemory struct {
+	MemoryKeyMaker
+}
+
+func (rdl *RollingDataLoaderMemory) FetchData() ([]int, error) {
+	if stored, ok := rdl.Store.get(rdl.MakeKey()).([]int); ok && len(stored) >= 3 {
+		return []int{stored[0], stored[1], stored[2]}, nil
+	}
+	return []int{0, 0, 0}, nil
+}
+
+func (rdl *RollingDataLoaderMemory) Load(*Stat) (StatData, error) {
+	data, _ := rdl.FetchData()
+	return &RollingData{ProportionData: ProportionData{Current: data[0], Total: data[1]}, Peak: data[2], dataLoader: rdl}, nil
+}
+
+func (rdl *RollingDataLoaderMemory) String() string {
+	return rdl.RedisKeyMaker.String()
+}
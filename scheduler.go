@@ -0,0 +1,139 @@
+package arithmospora
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// StatDataScheduled is implemented by stat data which changes with the
+// passage of time, such as moving windows. NextRefresh returns when the data
+// next needs refreshing after the given time, or the zero time if never
+type StatDataScheduled interface {
+	NextRefresh(time.Time) time.Time
+}
+
+// Scheduler refreshes stats when their data changes with the passage of
+// time, and notifies their listeners. Stats schedule themselves as they load
+// and unschedule themselves as they reset or stop. The scheduler runs only
+// while stats are scheduled.
+type Scheduler struct {
+	Clock   Clock
+	mu      sync.Mutex
+	errors  chan<- error
+	done    <-chan struct{}
+	entries map[*Stat]time.Time
+	wake    chan struct{}
+	started bool
+}
+
+func NewScheduler(clock Clock) *Scheduler {
+	if clock == nil {
+		clock = SystemClock
+	}
+	return &Scheduler{
+		Clock:   clock,
+		entries: make(map[*Stat]time.Time),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// ReportErrorsTo sets the channel on which refresh errors are reported until
+// ctx is done
+func (sc *Scheduler) ReportErrorsTo(ctx context.Context, errors chan<- error) {
+	sc.mu.Lock()
+	sc.errors, sc.done = errors, ctx.Done()
+	sc.mu.Unlock()
+}
+
+// Schedule arranges for stat to be refreshed at the given time, replacing
+// any existing schedule for the stat, and starts the scheduler if not
+// already running
+func (sc *Scheduler) Schedule(stat *Stat, at time.Time) {
+	sc.mu.Lock()
+	sc.entries[stat] = at
+	if !sc.started {
+		sc.started = true
+		go sc.run()
+	}
+	sc.mu.Unlock()
+	sc.poke()
+}
+
+func (sc *Scheduler) Unschedule(stat *Stat) {
+	sc.mu.Lock()
+	delete(sc.entries, stat)
+	sc.mu.Unlock()
+	sc.poke()
+}
+
+// poke wakes the scheduler to reconsider its next wake up time
+func (sc *Scheduler) poke() {
+	select {
+	case sc.wake <- struct{}{}:
+	default:
+	}
+}
+
+// due removes and returns the stats due for refresh at the given time,
+// along with the time the next stat is due, or the zero time if none are.
+// If no stats are due or scheduled the scheduler is marked stopped
+func (sc *Scheduler) due(now time.Time) (due []*Stat, next time.Time) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if len(sc.entries) == 0 {
+		sc.started = false
+		return nil, next
+	}
+	for stat, at := range sc.entries {
+		if !at.After(now) {
+			due = append(due, stat)
+			delete(sc.entries, stat)
+		} else if next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	return due, next
+}
+
+func (sc *Scheduler) run() {
+	for {
+		due, next := sc.due(sc.Clock.Now())
+		if len(due) == 0 && next.IsZero() {
+			return
+		}
+		for _, stat := range due {
+			go sc.refresh(stat)
+		}
+
+		var timer <-chan time.Time
+		if !next.IsZero() {
+			timer = sc.Clock.After(next.Sub(sc.Clock.Now()))
+		}
+		select {
+		case <-timer:
+		case <-sc.wake:
+		}
+	}
+}
+
+func (sc *Scheduler) refresh(stat *Stat) {
+	if err := stat.Refresh(); err != nil {
+		sc.mu.Lock()
+		errors, done := sc.errors, sc.done
+		sc.mu.Unlock()
+		if errors != nil {
+			select {
+			case errors <- fmt.Errorf("%v scheduled Stat.refresh(): %v", stat.Name, err):
+			case <-done:
+			}
+		}
+	} else {
+		stat.NotifyListeners(StatEvent{Scheduled: true})
+	}
+
+	stat.Lock()
+	defer stat.Unlock()
+	stat.schedule()
+}
@@ -0,0 +1,141 @@
+package arithmospora
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+// windowData is stat data which moves along at every multiple of its period
+type windowData struct {
+	period time.Duration
+}
+
+func (wd *windowData) Refresh() error {
+	return nil
+}
+
+func (wd *windowData) MarshalJSON() ([]byte, error) {
+	return json.Marshal(wd.period.String())
+}
+
+func (wd *windowData) String() string {
+	return wd.period.String()
+}
+
+func (wd *windowData) NextRefresh(now time.Time) time.Time {
+	return now.Truncate(wd.period).Add(wd.period)
+}
+
+type windowDataLoader struct {
+	period time.Duration
+}
+
+func (wdl *windowDataLoader) Load(stat *Stat) (StatData, error) {
+	return &windowData{wdl.period}, nil
+}
+
+func (wdl *windowDataLoader) String() string {
+	return fmt.Sprintf("window every %v", wdl.period)
+}
+
+func TestSchedulerRefreshesAcrossWindows(t *testing.T) {
+	start := time.Date(2026, 10, 19, 10, 0, 30, 0, time.UTC)
+	clock := newFakeClock(start)
+	scheduler := NewScheduler(clock)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewMemoryStore()
+	listeners := make(map[string]*StatListener)
+	for name, period := range map[string]time.Duration{"minutely": time.Minute, "hourly": time.Hour} {
+		stat := &Stat{
+			Name:            name,
+			DataLoader:      &windowDataLoader{period},
+			DataPointLoader: &MemoryDataPointLoader{MemoryKeyMaker{RedisKeyMaker{RedisPrefix: name}, store}},
+			Scheduler:       scheduler,
+			Clock:           clock,
+		}
+		listeners[name] = stat.Listen(ctx, "test")
+		if err := stat.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		defer stat.Stop()
+	}
+
+	tests := []struct {
+		at        time.Duration
+		refreshed []string
+	}{
+		{29 * time.Second, nil},
+		{30 * time.Second, []string{"minutely"}},
+		{89 * time.Second, nil},
+		{90 * time.Second, []string{"minutely"}},
+		// Several windows passing at once refresh the stat once
+		{58*time.Minute + 30*time.Second, []string{"minutely"}},
+		{59*time.Minute + 30*time.Second, []string{"hourly", "minutely"}},
+		{60 * time.Minute, nil},
+	}
+	for _, test := range tests {
+		at := start.Add(test.at)
+		clock.Set(at)
+		var refreshed []string
+		for name, listener := range listeners {
+			wait := 100 * time.Millisecond
+			for _, expected := range test.refreshed {
+				if expected == name {
+					wait = 2 * time.Second
+				}
+			}
+			select {
+			case <-listener.Ready():
+				if event, ok := listener.Next(); ok && event.Scheduled {
+					refreshed = append(refreshed, name)
+				}
+			case <-time.After(wait):
+			}
+		}
+		sort.Strings(refreshed)
+		if fmt.Sprint(refreshed) != fmt.Sprint(test.refreshed) {
+			t.Errorf("at %s refreshed %v, want %v", at.Format("15:04:05"), refreshed, test.refreshed)
+		}
+	}
+}
+
+func TestSchedulerMovesTimedDataWindows(t *testing.T) {
+	start := timedStatStart
+	clock := newFakeClock(start.Add(150 * time.Minute))
+	stat, store := newMemoryTimedStat(t, clock, []Period{{Granularity: 3600, Cycles: 3, Cumulative: true}}, 1, 2, 4)
+	hour := start.Unix() / 3600
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stat.Scheduler = NewScheduler(clock)
+	listener := stat.Listen(ctx, "test")
+	if err := stat.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	defer stat.Stop()
+
+	// Crossing the hour boundary refreshes the stat without being asked
+	store.SetBucket("election:stats:votes:datapoints:3600", hour+3, 8)
+	clock.Set(start.Add(190 * time.Minute))
+	select {
+	case <-listener.Ready():
+	case <-time.After(2 * time.Second):
+		t.Fatal("listener not notified as the window moved")
+	}
+	if event, ok := listener.Next(); !ok || !event.Scheduled {
+		t.Errorf("notified with %+v, want a scheduled event", event)
+	}
+	want := map[string]map[int64]float64{
+		"3600":            {hour: 1, hour + 1: 2, hour + 2: 4, hour + 3: 8},
+		"3600:cumulative": {hour: 1, hour + 1: 3, hour + 2: 7, hour + 3: 15},
+	}
+	if got := timedDataPoints(t, stat); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("after the hour scheduled %v, want %v", got, want)
+	}
+}
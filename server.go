@@ -0,0 +1,235 @@
+package arithmospora
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Sources which are live are periodically refreshed in full to pick up any
+// changes missed by their ordinary updates
+const refreshAllInterval = 120 * time.Second
+
+// Server serves the sources of a config to websocket clients. It owns the
+// Redis pool shared by the sources' stats, a hub per source and the HTTP mux
+// routing to them, so several differently configured servers can run in one
+// process. Errors encountered while serving are sent to Errors, which must be
+// drained. In a cluster, a leader also feeds its followers, and a follower
+// serves its leader's feed without loading its sources itself
+type Server struct {
+	Config  *Config
+	Pool    *redis.Pool
+	Sources []*Source
+	Hubs    map[string]*Hub
+	Mux     *http.ServeMux
+	Errors  chan error
+	mu      sync.Mutex
+	http    *http.Server
+	addr    net.Addr
+	stopped chan error
+	cancel  context.CancelFunc
+	records []*os.File
+	feed    net.Addr
+}
+
+// NewServer makes the sources of the config and their hubs, and routes each
+// source's websocket and announcement endpoints on the server's mux. Nothing
+// is loaded or served until Start is called
+func NewServer(config *Config) *Server {
+	return NewServerWithClock(config, SystemClock)
+}
+
+// NewServerWithClock makes a server whose sources use the given clock, e.g.
+// to replay recorded refreshes
+func NewServerWithClock(config *Config, clock Clock) *Server {
+	server := &Server{
+		Config:  config,
+		Pool:    config.Redis.NewPool(),
+		Hubs:    make(map[string]*Hub),
+		Mux:     http.NewServeMux(),
+		Errors:  make(chan error),
+		stopped: make(chan error, 1),
+	}
+	server.Sources = MakeSourcesFromConfigWithClock(config, server.Pool, clock)
+
+	for _, s := range server.Sources {
+		source := s
+		hub := NewHub(source, config.Websocket)
+		server.Hubs[source.Name] = hub
+		server.Mux.HandleFunc("/"+source.Name, func(w http.ResponseWriter, r *http.Request) {
+			ServeWs(hub, w, r, server.Errors)
+		})
+		// Followers relay their leader's announcements
+		if token := config.Announcements.Token; token != "" && config.Cluster.Role != ClusterFollower {
+			server.Mux.HandleFunc("/"+source.Name+"/announce", func(w http.ResponseWriter, r *http.Request) {
+				ServeAnnounce(source, hub, w, r, token)
+			})
+		}
+	}
+	return server
+}
+
+// Source returns the named source, or the first source if name is empty, or
+// nil if there is no such source
+func (s *Server) Source(name string) *Source {
+	for i, source := range s.Sources {
+		if source.Name == name || (name == "" && i == 0) {
+			return source
+		}
+	}
+	return nil
+}
+
+// Start runs the hubs, publishes the sources, recording their refreshes if
+// configured, and serves on the configured https or http address. Start
+// returns once the server is listening: the error with which it stops
+// serving is then received from Stopped. A cluster leader also serves its
+// feed, and a follower runs only its hubs, relaying its leader's feed to
+// them. The hubs, sources and their goroutines stop when ctx is done or the
+// server is shut down
+func (s *Server) Start(ctx context.Context) error {
+	address := s.Config.Https.Address
+	if address == "" {
+		address = s.Config.Http.Address
+	}
+	if address == "" {
+		return fmt.Errorf("missing address in configuration http or https section")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.http != nil {
+		return fmt.Errorf("server already started")
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+
+	switch s.Config.Cluster.Role {
+	case ClusterFollower:
+		for _, source := range s.Sources {
+			go s.Hubs[source.Name].Run(ctx)
+		}
+		go s.follow(ctx)
+		return s.serve(address)
+	case ClusterLeader:
+		listener, err := net.Listen("tcp", s.Config.Cluster.Address)
+		if err != nil {
+			return fmt.Errorf("cluster feed: %v", err)
+		}
+		s.feed = listener.Addr()
+		go s.serveFeed(ctx, listener)
+	}
+
+	for i, source := range s.Sources {
+		hub := s.Hubs[source.Name]
+		go hub.Run(ctx)
+		if err := source.Publish(ctx, hub, s.Errors); err != nil {
+			return fmt.Errorf("source %s: %v", source.Name, err)
+		}
+
+		// Record refreshes for replay if configured
+		if recordFile := s.Config.Sources[i].RecordFile; recordFile != "" {
+			recording, err := os.OpenFile(recordFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				return fmt.Errorf("source %s: cannot open record file: %v", source.Name, err)
+			}
+			s.records = append(s.records, recording)
+			source.Record(ctx, recording, s.Errors)
+		}
+
+		if source.IsLive {
+			go s.refreshPeriodically(ctx, source)
+		}
+	}
+
+	return s.serve(address)
+}
+
+// serve listens on the address and serves the mux until shut down
+func (s *Server) serve(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	s.addr = listener.Addr()
+	s.http = &http.Server{Handler: s.Mux}
+	go func() {
+		var err error
+		if https := s.Config.Https; https.Cert != "" && https.Key != "" {
+			err = s.http.ServeTLS(listener, https.Cert, https.Key)
+		} else {
+			err = s.http.Serve(listener)
+		}
+		if err == http.ErrServerClosed {
+			err = nil
+		}
+		s.stopped <- err
+	}()
+	return nil
+}
+
+func (s *Server) refreshPeriodically(ctx context.Context, source *Source) {
+	ticker := time.NewTicker(refreshAllInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			source.RefreshAll(ctx, s.Errors)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Addr returns the address the server is listening on, e.g. to find the port
+// chosen for an address of "127.0.0.1:0", or nil if not started
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addr
+}
+
+// FeedAddr returns the address on which a cluster leader serves its feed, or
+// nil if not started as a leader
+func (s *Server) FeedAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.feed
+}
+
+// Stopped receives the error with which the server stopped serving, or nil
+// once shut down
+func (s *Server) Stopped() <-chan error {
+	return s.stopped
+}
+
+// Shutdown stops the hubs and sources, disconnecting websocket clients, and
+// stops serving, waiting for in-flight HTTP requests until ctx is done. Record
+// files and the Redis pool are then closed
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.cancel != nil {
+		s.cancel()
+	}
+	if s.http != nil {
+		err = s.http.Shutdown(ctx)
+	}
+	for _, recording := range s.records {
+		if closeErr := recording.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	s.records = nil
+	if closeErr := s.Pool.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
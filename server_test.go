@@ -0,0 +1,122 @@
+package arithmospora
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// memoryServerConfig returns the config of a server on a free port with a
+// live source, election, of the given memory stats
+func memoryServerConfig(stats StatGroupConfig) *Config {
+	start := time.Now().Add(-time.Hour)
+	return &Config{
+		Http: HttpConfig{Address: "127.0.0.1:0"},
+		Sources: []SourceConfig{{
+			Name:             "election",
+			RedisPrefix:      "election",
+			IsLive:           true,
+			StartTime:        start,
+			EndTime:          start.Add(48 * time.Hour),
+			TimedStatPeriods: []Period{{Granularity: 60, Cycles: 60}},
+			Stats:            stats,
+		}},
+	}
+}
+
+// startServer starts a server with the config, logging its errors, and
+// returns a function shutting it down, which is also called when the test
+// ends. Errors are drained only while the server runs
+func startServer(t *testing.T, config *Config) (*Server, func()) {
+	t.Helper()
+	server := NewServer(config)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for {
+			select {
+			case err := <-server.Errors:
+				t.Log(err)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	if err := server.Start(ctx); err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+
+	var once sync.Once
+	shutdown := func() {
+		once.Do(func() {
+			defer cancel()
+			if err := server.Shutdown(context.Background()); err != nil {
+				t.Error(err)
+			}
+			if err := <-server.Stopped(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	t.Cleanup(shutdown)
+	return server, shutdown
+}
+
+// runMemoryServer starts a server with memory stats, connects a client,
+// updates and reloads the stats, then shuts the server down
+func runMemoryServer(t *testing.T) {
+	t.Helper()
+	server, shutdown := startServer(t, memoryServerConfig(StatGroupConfig{
+		Proportion: []StatConfig{
+			{Name: "total", LoaderType: "memory"},
+			{Name: "polled", LoaderType: "memory", UpdateMode: UpdateModePoll, PollIntervalMs: 5},
+		},
+		Timed: []StatConfig{{Name: "votes", LoaderType: "memory"}},
+	}))
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+server.Addr().String()+"/election", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	source := server.Source("election")
+	for i := 1; i <= 5; i++ {
+		source.MemoryStore.SetProportion("election:stats:total", i, 10)
+		source.MemoryStore.Update("election:stats:total")
+		time.Sleep(5 * time.Millisecond)
+	}
+	source.RefreshAll(context.Background(), server.Errors)
+	shutdown()
+}
+
+func TestServerShutdownStopsGoroutines(t *testing.T) {
+	runMemoryServer(t)
+	time.Sleep(100 * time.Millisecond)
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 10; i++ {
+		runMemoryServer(t)
+	}
+
+	// Goroutines wind down asynchronously after shutdown
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines after shutdown, want %d\n%s", runtime.NumGoroutine(), baseline, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -40,11 +40,11 @@ func (svd *SingleValueData) MilestoneValue(string) float64 {
 }
 
 type SingleValueDataLoaderRedis struct {
-	RedisKeyMaker
+	RedisPoolKeyMaker
 }
 
 func (svdl *SingleValueDataLoaderRedis) FetchData() (int, error) {
-	conn := RedisPool().Get()
+	conn := svdl.Pool.Get()
 	defer conn.Close()
 
 	data, err := redis.Int(conn.Do("GET", svdl.MakeKey("data")))
@@ -62,3 +62,17 @@ func (svdl *SingleValueDataLoaderRedis) Load(stat *Stat) (StatData, error) {
 
 	return &SingleValueData{Name: stat.Name, Data: data, dataLoader: svdl}, nil
 }
+
+type SingleValueDataLoaderMemory struct {
+	MemoryKeyMaker
+}
+
+func (svdl *SingleValueDataLoaderMemory) FetchData() (int, error) {
+	data, _ := svdl.Store.get(svdl.MakeKey()).(int)
+	return data, nil
+}
+
+func (svdl *SingleValueDataLoaderMemory) Load(stat *Stat) (StatData, error) {
+	data, _ := svdl.FetchData()
+	return &SingleValueData{Name: stat.Name, Data: data, dataLoader: svdl}, nil
+}
@@ -0,0 +1,107 @@
+package arithmospora
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Snapshot holds the stats of a source in the form output by aslist -f json:
+// stat groups suffixed "Stats", each mapping stat keys such as "total" or
+// "5m:total" to the stat's data and datapoints. Snapshots serve stats with
+// loader_type "file", e.g. for archived sources no longer held in Redis.
+type Snapshot map[string]map[string]SnapshotStat
+
+type SnapshotStat struct {
+	Name       string                  `json:"name"`
+	Data       interface{}             `json:"data"`
+	DataPoints map[string]SnapshotStat `json:"dataPoints"`
+}
+
+// Stat returns the stat with the given key from whichever group holds it
+func (sn Snapshot) Stat(statKey string) (SnapshotStat, bool) {
+	for _, stats := range sn {
+		if stat, ok := stats[statKey]; ok {
+			return stat, true
+		}
+	}
+	return SnapshotStat{}, false
+}
+
+// Store writes the stat and its datapoints to a memory store or other data
+// store at the given key, interpreting the data according to the stat's data
+// type. Missing or malformed values are stored as zero
+func (ss SnapshotStat) Store(store StatWriter, key string, dataType string, fields []string) {
+	data, _ := ss.Data.(map[string]interface{})
+	switch dataType {
+	case "generic":
+		generic := make(map[string]int, len(data))
+		for field, value := range data {
+			generic[field] = snapshotInt(value)
+		}
+		store.SetGeneric(key, generic)
+	case "proportion":
+		store.SetProportion(key, snapshotInt(data["current"]), snapshotInt(data["total"]))
+	case "rolling":
+		store.SetRolling(key, snapshotInt(data["current"]), snapshotInt(data["total"]), snapshotInt(data["peak"]))
+	case "single_value":
+		// Single values are keyed by the name of the stat or datapoint
+		for _, value := range data {
+			store.SetSingleValue(key, snapshotInt(value))
+		}
+	case "timed":
+		storeSnapshotBuckets(store, key, data, fields)
+	}
+
+	var dpNames []string
+	for dpName, dp := range ss.DataPoints {
+		// Cumulative views are computed from the buckets of their period
+		if dataType == "timed" && strings.HasSuffix(dpName, CumulativeSuffix) {
+			continue
+		}
+		dpNames = append(dpNames, dpName)
+		dp.Store(store, makeKey(key, "datapoints", dpName), dataType, fields)
+	}
+	store.SetDataPoints(key, dpNames...)
+}
+
+// storeSnapshotBuckets stores timed buckets given as a map of bucket keys to
+// values, or in columnar form for stats with fields
+func storeSnapshotBuckets(store StatWriter, key string, data map[string]interface{}, fields []string) {
+	if len(fields) == 0 {
+		for bucketKey, value := range data {
+			if bucket, err := strconv.ParseInt(bucketKey, 10, 64); err == nil {
+				store.SetBucket(key, bucket, snapshotFloat(value))
+			}
+		}
+		return
+	}
+
+	bucketKeys, _ := data["buckets"].([]interface{})
+	series, _ := data["series"].(map[string]interface{})
+	for i, bucketKey := range bucketKeys {
+		values := make([]float64, len(fields))
+		for index, field := range fields {
+			if fieldValues, ok := series[field].([]interface{}); ok && i < len(fieldValues) {
+				values[index] = snapshotFloat(fieldValues[i])
+			}
+		}
+		store.SetBucket(key, int64(snapshotFloat(bucketKey)), values...)
+	}
+}
+
+// snapshotFloat converts a number decoded from JSON or TOML
+func snapshotFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case int64:
+		return float64(v)
+	case int:
+		return float64(v)
+	}
+	return 0
+}
+
+func snapshotInt(value interface{}) int {
+	return int(snapshotFloat(value))
+}
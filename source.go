@@ -1,25 +1,52 @@
 package arithmospora
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/garyburd/redigo/redis"
 )
 
 type Source struct {
-	Name              string
-	IsLive            bool
-	Available         map[string][]string
-	Stats             map[string]map[string]*Stat
-	Milestones        []*MilestoneCollection
-	updatesCountMu    sync.Mutex
-	updatesCount      int
-	milestonesCountMu sync.Mutex
-	milestonesCount   int
+	Name                    string
+	IsLive                  bool
+	TimedDeltas             bool
+	Debounce                DebounceConfig
+	Clock                   Clock
+	Available               map[string][]string
+	Stats                   map[string]map[string]*Stat
+	Milestones              []*MilestoneCollection
+	updatesCountMu          sync.Mutex
+	updatesCount            int
+	milestonesCountMu       sync.Mutex
+	milestonesCount         int
+	announcements           announcementList
+	MemoryStore             *MemoryStore
+	redisPool               *redis.Pool
+	redisSubscriber         *RedisSubscriber
+	redisKeyspaceSubscriber *RedisSubscriber
+	upstream                *UpstreamClient
+	scheduler               *Scheduler
 }
 
-func (s *Source) Publish(hub *Hub, errors chan<- error) error {
-	debounce := Config.Debounce
+// Publish loads the source's stats, listening for updates if the source is
+// live, and broadcasts stat updates and achieved milestones to the hub's
+// clients until ctx is done
+func (s *Source) Publish(ctx context.Context, hub *Hub, errors chan<- error) error {
+	debounce := s.Debounce
+	if s.scheduler != nil {
+		s.scheduler.ReportErrorsTo(ctx, errors)
+	}
+
+	// Stats followed from an upstream server are loaded once its initial
+	// data has arrived
+	if err := s.FollowUpstream(ctx, errors); err != nil {
+		return err
+	}
 
 	// Publish stats
 	for sg, stats := range s.Stats {
@@ -30,7 +57,7 @@ func (s *Source) Publish(hub *Hub, errors chan<- error) error {
 
 			if s.IsLive {
 				// Source is live: listen for updates
-				if err := stat.ListenForUpdates(time.Duration(debounce.MinTimeMs)*time.Millisecond, time.Duration(debounce.MaxTimeMs)*time.Millisecond, errors); err != nil {
+				if err := stat.ListenForUpdates(ctx, time.Duration(debounce.MinTimeMs)*time.Millisecond, time.Duration(debounce.MaxTimeMs)*time.Millisecond, errors); err != nil {
 					return err
 				}
 			} else {
@@ -40,18 +67,40 @@ func (s *Source) Publish(hub *Hub, errors chan<- error) error {
 				}
 			}
 
+			listener := stat.Listen(ctx, "publish")
 			go func() {
-				updated := make(chan bool)
-				stat.RegisterListener(updated)
+				// Stats of sources which aren't live are still refreshed by
+				// the scheduler, so stop them too
+				defer stat.Stop()
 				for {
-					_ = <-updated
+					select {
+					case <-listener.Ready():
+					case <-listener.Done():
+						return
+					}
+					statEvent, ok := listener.Next()
+					if !ok {
+						continue
+					}
 					s.IncrementUpdatesCounter()
-					message, err := json.Marshal(Message{Event: "stats:" + statGroup + ":" + statKey, Payload: stat})
+					// With timed deltas enabled, timed stats send only the
+					// buckets changed since the last event taken
+					event, payload := "stats:"+statGroup+":"+statKey, interface{}(stat)
+					if s.TimedDeltas && statGroup == "timed" {
+						event, payload = event+":delta", stat.Delta(statEvent.Changed)
+					}
+					message, err := json.Marshal(Message{Event: event, Payload: payload})
 					if err != nil {
-						errors <- err
+						select {
+						case errors <- err:
+						case <-ctx.Done():
+							return
+						}
 						continue
 					}
-					hub.Broadcast <- message
+					if !hub.broadcast(message) {
+						return
+					}
 				}
 			}()
 		}
@@ -59,19 +108,29 @@ func (s *Source) Publish(hub *Hub, errors chan<- error) error {
 
 	// Publish milestones
 	for _, mc := range s.Milestones {
-		milestoneCollection := mc
+		milestoneAchieved := make(chan *Milestone)
+		mc.Publish(ctx, milestoneAchieved)
 		go func() {
-			milestoneAchieved := make(chan *Milestone)
-			milestoneCollection.Publish(milestoneAchieved)
 			for {
-				milestone := <-milestoneAchieved
+				var milestone *Milestone
+				select {
+				case milestone = <-milestoneAchieved:
+				case <-ctx.Done():
+					return
+				}
 				s.IncrementMilestonesCounter()
 				message, err := json.Marshal(Message{Event: "milestone", Payload: *milestone})
 				if err != nil {
-					errors <- err
+					select {
+					case errors <- err:
+					case <-ctx.Done():
+						return
+					}
 					continue
 				}
-				hub.Broadcast <- message
+				if !hub.broadcast(message) {
+					return
+				}
 			}
 		}()
 	}
@@ -79,52 +138,105 @@ func (s *Source) Publish(hub *Hub, errors chan<- error) error {
 	return nil
 }
 
-func (s *Source) RefreshAll(errors chan<- error) {
+// FollowUpstream connects to the upstream server of a source with stats of
+// loader_type "upstream", returning once their initial data has been
+// received into the memory store, and keeps them up to date until ctx is
+// done. Publish follows the upstream itself: FollowUpstream is for loading
+// the stats without publishing them
+func (s *Source) FollowUpstream(ctx context.Context, errors chan<- error) error {
+	if s.upstream == nil {
+		return nil
+	}
+	return s.upstream.Start(ctx, errors)
+}
+
+// RefreshAll backfills all stats, picking up any changes missed by their
+// ordinary refreshes, and notifies their listeners. Errors are reported
+// until ctx is done
+func (s *Source) RefreshAll(ctx context.Context, errors chan<- error) {
 	for _, stats := range s.Stats {
 		for _, stat := range stats {
-			if err := stat.Refresh(); err != nil {
-				errors <- err
+			if err := stat.Backfill(); err != nil {
+				select {
+				case errors <- err:
+				case <-ctx.Done():
+					return
+				}
 				continue
 			}
-			stat.NotifyListeners()
+			stat.NotifyListeners(StatEvent{Full: true})
 		}
 	}
 }
 
-func (s *Source) SendInitialDataTo(client *Client) error {
-	// Provide available stats message for this source
-	available, err := json.Marshal(Message{Event: "available", Payload: s.Available})
-	if err != nil {
-		return err
+// availableMessage returns the message giving the source's available stats,
+// numbered seq, the sequence number of the last message broadcast before it
+func (s *Source) availableMessage(seq uint64) ([]byte, error) {
+	return json.Marshal(Message{Seq: seq, Version: ProtocolVersion, Event: "available", Payload: s.Available})
+}
+
+// initialData returns the messages sent to a client once it is ready: every
+// stat, then the pinned announcements
+func (s *Source) initialData() (messages [][]byte) {
+	for statGroup, stats := range s.Stats {
+		for statKey, stat := range stats {
+			message, err := json.Marshal(Message{Event: "stats:" + statGroup + ":" + statKey, Payload: stat})
+			if err != nil {
+				continue
+			}
+			messages = append(messages, message)
+		}
+	}
+	for _, announcement := range s.PinnedAnnouncements() {
+		message, err := json.Marshal(Message{Event: "announcement", Payload: announcement})
+		if err != nil {
+			continue
+		}
+		messages = append(messages, message)
 	}
-	select {
-	case <-client.closed:
+	return messages
+}
+
+// statForEvent returns the stat sent in full by an event, e.g.
+// stats:other:totalvotes, or nil if there is none
+func (s *Source) statForEvent(event string) *Stat {
+	parts := strings.SplitN(event, ":", 3)
+	if len(parts) != 3 || parts[0] != "stats" {
 		return nil
-	default:
-		client.send <- available
 	}
+	return s.Stats[parts[1]][parts[2]]
+}
 
-	// Send initial data after a short delay to allow the client time to
-	// process available stats and set up listeners
-	go func() {
-		_ = <-time.After(100 * time.Millisecond)
-		for statGroup, stats := range s.Stats {
-			for statKey, stat := range stats {
-				message, err := json.Marshal(Message{Event: "stats:" + statGroup + ":" + statKey, Payload: stat})
-				if err != nil {
-					continue
-				}
-				select {
-				case <-client.closed:
-					return
-				default:
-					client.send <- message
+// statMessage returns the message sending a stat in full, given its event
+func (s *Source) statMessage(event string) ([]byte, error) {
+	stat := s.statForEvent(event)
+	if stat == nil {
+		return nil, fmt.Errorf("source %s: no stat for event %s", s.Name, event)
+	}
+	return json.Marshal(Message{Event: event, Payload: stat})
+}
+
+// snapshotMessage returns a snapshot message sending every stat in full,
+// keyed by stat group and key
+func (s *Source) snapshotMessage() ([]byte, error) {
+	return json.Marshal(Message{Event: "snapshot", Payload: s.Stats})
+}
+
+// SlowListeners returns the metrics of the listeners of the source's stats
+// whose pending event has waited longer than threshold, named by stat group
+// and key, e.g. proportion:total:publish
+func (s *Source) SlowListeners(threshold time.Duration) (slow []StatListenerStats) {
+	for statGroup, stats := range s.Stats {
+		for statKey, stat := range stats {
+			for _, listenerStats := range stat.ListenerStats() {
+				if listenerStats.PendingFor > threshold {
+					listenerStats.Name = statGroup + ":" + statKey + ":" + listenerStats.Name
+					slow = append(slow, listenerStats)
 				}
 			}
 		}
-	}()
-
-	return nil
+	}
+	return slow
 }
 
 func (s *Source) IncrementUpdatesCounter() {
@@ -1,8 +1,10 @@
 package arithmospora
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"sync"
 	"time"
 )
@@ -24,8 +26,66 @@ type StatDataPointLoader interface {
 	NewDataPointLoader(string) StatDataPointLoader
 }
 
+// StatDataPointsRefresher is implemented by stat data which refreshes the
+// data of its datapoints together, e.g. in a single round trip, in place of
+// the datapoints refreshing themselves. Implementations lock each datapoint
+// only while reading or applying its data, not while fetching, so that the
+// datapoints can be marshalled meanwhile. The flag requests a full backfill
+type StatDataPointsRefresher interface {
+	RefreshDataPoints([]*Stat, bool) error
+}
+
+// StatDataBackfiller is implemented by stat data for which Refresh may miss
+// late changes, and which can refetch its data in full
+type StatDataBackfiller interface {
+	Backfill() error
+}
+
+// StatDataDeltaMarshaler is implemented by stat data which can encode only
+// the given changed buckets, as taken by StatDataChangeTracker
+type StatDataDeltaMarshaler interface {
+	MarshalDeltaJSON(changed []int64) ([]byte, error)
+}
+
+// StatDataChangeTracker is implemented by stat data which tracks which of
+// its buckets have changed, for the events notifying listeners of changes
+type StatDataChangeTracker interface {
+	TakeChangedBuckets() []int64
+}
+
+// StatUpdateListener sends true on the given channel when the stat's data is
+// updated, and false when updates may have been missed (e.g. after a lost
+// connection) and the stat needs a full resync. Problems and changes of
+// state are reported on the errors channel. The subscription ends, releasing
+// any goroutines and connections it holds, once the context is done
 type StatUpdateListener interface {
-	Subscribe(chan<- bool)
+	Subscribe(context.Context, chan<- bool, chan<- error)
+}
+
+// PollUpdateListener signals an update at a fixed interval, for data stores
+// which cannot notify of changes. Stats refreshed by polling notify their
+// listeners only when a fingerprint of their data has changed
+type PollUpdateListener struct {
+	Interval time.Duration
+	Clock    Clock
+}
+
+func (pul *PollUpdateListener) Subscribe(ctx context.Context, updated chan<- bool, errors chan<- error) {
+	clock := clockOrSystem(pul.Clock)
+	go func() {
+		for {
+			select {
+			case <-clock.After(pul.Interval):
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case updated <- true:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 }
 
 type Stat struct {
@@ -35,23 +95,43 @@ type Stat struct {
 	DataLoader      StatDataLoader
 	DataPointLoader StatDataPointLoader
 	UpdateListener  StatUpdateListener
+	Scheduler       *Scheduler
+	Clock           Clock
 	data            StatData
 	dataPointNames  []string
 	dataPoints      map[string]*Stat
-	listeners       []chan<- bool
+	refreshMu       sync.Mutex
+	listenersMu     sync.Mutex
+	listeners       []*StatListener
+	stopped         bool
 }
 
 func (s *Stat) Reset() {
 	s.Lock()
 	defer s.Unlock()
+	s.reset()
+}
+
+// reset clears the stat's data. Must be called with the lock held
+func (s *Stat) reset() {
+	if s.Scheduler != nil {
+		s.Scheduler.Unschedule(s)
+	}
+	s.stopped = false
 	s.data = nil
 	s.dataPointNames = []string{}
 	s.dataPoints = make(map[string]*Stat)
 }
 
-func (s *Stat) Load() (err error) {
+func (s *Stat) Load() error {
 	s.Lock()
 	defer s.Unlock()
+	return s.load()
+}
+
+// load loads the stat's data and datapoints. Must be called with the lock
+// held
+func (s *Stat) load() (err error) {
 	s.data, err = s.DataLoader.Load(s)
 	if err != nil {
 		return err
@@ -68,6 +148,7 @@ func (s *Stat) Load() (err error) {
 			DataLoader:      s.DataPointLoader.NewDataLoader(s.DataLoader, dpName),
 			DataPointLoader: s.DataPointLoader.NewDataPointLoader(dpName),
 			Depth:           s.Depth + 1,
+			Clock:           s.Clock,
 		}
 		if err := dp.Reload(); err != nil {
 			return err
@@ -75,51 +156,197 @@ func (s *Stat) Load() (err error) {
 		s.dataPoints[dpName] = &dp
 	}
 
+	s.schedule()
 	return err
 }
 
+// schedule registers the stat with its scheduler if its data changes with
+// the passage of time. Must be called with the lock held
+func (s *Stat) schedule() {
+	if s.Scheduler == nil || s.stopped {
+		return
+	}
+	if scheduled, ok := s.data.(StatDataScheduled); ok {
+		if next := scheduled.NextRefresh(s.Scheduler.Clock.Now()); !next.IsZero() {
+			s.Scheduler.Schedule(s, next)
+		}
+	}
+}
+
+// Reload resets and loads the stat under one lock, so that it is never seen
+// reset part way through
 func (s *Stat) Reload() error {
-	s.Reset()
-	return s.Load()
+	s.Lock()
+	defer s.Unlock()
+	s.reset()
+	return s.load()
+}
+
+// Stop unschedules the stat so that it is no longer refreshed with the
+// passage of time, until it is next reloaded
+func (s *Stat) Stop() {
+	s.Lock()
+	defer s.Unlock()
+	s.stopped = true
+	if s.Scheduler != nil {
+		s.Scheduler.Unschedule(s)
+	}
 }
 
 func (s *Stat) RefreshData() error {
+	return s.refreshData(false)
+}
+
+func (s *Stat) refreshData(full bool) error {
 	s.Lock()
 	defer s.Unlock()
+	if backfiller, ok := s.data.(StatDataBackfiller); ok && full {
+		return backfiller.Backfill()
+	}
 	return s.data.Refresh()
 }
 
 func (s *Stat) RefreshDataPoints() error {
+	return s.refreshDataPoints(false)
+}
+
+func (s *Stat) refreshDataPoints(full bool) error {
+	// Take the datapoints as they are now, as a reload replaces them
+	s.Lock()
+	refresher, batched := s.data.(StatDataPointsRefresher)
+	dataPoints := make([]*Stat, 0, len(s.dataPointNames))
 	for _, dpName := range s.dataPointNames {
-		if err := s.dataPoints[dpName].Refresh(); err != nil {
+		dataPoints = append(dataPoints, s.dataPoints[dpName])
+	}
+	s.Unlock()
+
+	if batched {
+		// Datapoints aren't locked while their data is fetched, so batched
+		// refreshes take turns lest an earlier fetch be applied over a later
+		s.refreshMu.Lock()
+		defer s.refreshMu.Unlock()
+		return refresher.RefreshDataPoints(dataPoints, full)
+	}
+
+	for _, dp := range dataPoints {
+		if err := dp.refresh(full); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (s *Stat) Refresh() error {
-	if err := s.RefreshData(); err != nil {
+func (s *Stat) refresh(full bool) error {
+	if err := s.refreshData(full); err != nil {
 		return err
 	}
-	return s.RefreshDataPoints()
+	return s.refreshDataPoints(full)
+}
+
+func (s *Stat) Refresh() error {
+	return s.refresh(false)
+}
+
+// Backfill refreshes the stat in full, picking up any late changes which
+// Refresh may miss
+func (s *Stat) Backfill() error {
+	return s.refresh(true)
 }
 
 func (s *Stat) MarshalJSON() ([]byte, error) {
+	return s.marshalJSON(nil)
+}
+
+// Delta returns a marshaler encoding the stat with only the buckets of its
+// datapoints given as changed, as in StatEvent.Changed, for stat data which
+// supports it
+func (s *Stat) Delta(changed map[string][]int64) json.Marshaler {
+	return &statDelta{stat: s, dataPoints: changed}
+}
+
+// statDelta encodes a stat with only the changed buckets of its own data and
+// of its datapoints
+type statDelta struct {
+	stat       *Stat
+	changed    []int64
+	dataPoints map[string][]int64
+}
+
+func (sd *statDelta) MarshalJSON() ([]byte, error) {
+	return sd.stat.marshalJSON(sd)
+}
+
+// marshalJSON encodes the stat in full, or only what has changed if given a
+// delta
+func (s *Stat) marshalJSON(delta *statDelta) ([]byte, error) {
 	s.Lock()
 	defer s.Unlock()
-	dataJSON, err := json.Marshal(s.data)
+	var (
+		dataJSON       []byte
+		dataPointsJSON []byte
+		err            error
+	)
+	if deltaMarshaler, ok := s.data.(StatDataDeltaMarshaler); ok && delta != nil {
+		dataJSON, err = deltaMarshaler.MarshalDeltaJSON(delta.changed)
+	} else {
+		dataJSON, err = json.Marshal(s.data)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("json marshalling stat %s data: ", err)
+		return nil, fmt.Errorf("json marshalling stat %s data: %v", s.Name, err)
+	}
+	if delta != nil {
+		dataPointDeltas := make(map[string]json.Marshaler, len(s.dataPoints))
+		for dpName, dp := range s.dataPoints {
+			dataPointDeltas[dpName] = &statDelta{stat: dp, changed: delta.dataPoints[dpName]}
+		}
+		dataPointsJSON, err = json.Marshal(dataPointDeltas)
+	} else {
+		dataPointsJSON, err = json.Marshal(s.dataPoints)
 	}
-	dataPointsJSON, err := json.Marshal(s.dataPoints)
 	if err != nil {
-		return nil, fmt.Errorf("json marshalling stat %s dataPoints: ", err)
+		return nil, fmt.Errorf("json marshalling stat %s dataPoints: %v", s.Name, err)
 	}
 
 	return []byte(fmt.Sprintf(`{"name":"%s","data":%s,"dataPoints":%s}`, s.Name, dataJSON, dataPointsJSON)), nil
 }
 
+// fingerprint returns a hash of the stat's data, telling whether a refresh
+// has changed it
+func (s *Stat) fingerprint() (uint64, error) {
+	data, err := s.marshalJSON(nil)
+	if err != nil {
+		return 0, err
+	}
+	hash := fnv.New64a()
+	hash.Write(data)
+	return hash.Sum64(), nil
+}
+
+// takeChanges returns the buckets changed since they were last taken, by the
+// name of the datapoint they belong to, for datapoints which track changes
+func (s *Stat) takeChanges() map[string][]int64 {
+	s.Lock()
+	defer s.Unlock()
+	var changes map[string][]int64
+	for dpName, dp := range s.dataPoints {
+		dp.Lock()
+		tracker, ok := dp.data.(StatDataChangeTracker)
+		var buckets []int64
+		if ok {
+			buckets = tracker.TakeChangedBuckets()
+		}
+		dp.Unlock()
+		if len(buckets) == 0 {
+			continue
+		}
+		if changes == nil {
+			changes = make(map[string][]int64)
+		}
+		changes[dpName] = buckets
+	}
+	return changes
+}
+
 func (s *Stat) String() string {
 	s.Lock()
 	defer s.Unlock()
@@ -130,59 +357,83 @@ func (s *Stat) String() string {
 	return statString
 }
 
-func (s *Stat) ListenForUpdates(min time.Duration, max time.Duration, errors chan<- error) error {
+// ListenForUpdates loads the stat and refreshes it as its update listener
+// signals, debounced between min and max, until ctx is done, when the stat
+// is stopped
+func (s *Stat) ListenForUpdates(ctx context.Context, min time.Duration, max time.Duration, errors chan<- error) error {
 	if err := s.Reload(); err != nil {
 		return err
 	}
 
-	updated := make(chan bool)
-	s.UpdateListener.Subscribe(updated)
+	// Buffered so that update listeners can drop updates while one is
+	// pending instead of waiting for a refresh to finish
+	updated := make(chan bool, 1)
+	s.UpdateListener.Subscribe(ctx, updated, errors)
+	clock := clockOrSystem(s.Clock)
+
+	// Polled stats are refreshed whether or not their data has changed
+	_, polled := s.UpdateListener.(*PollUpdateListener)
+	var fingerprint uint64
+	if polled {
+		fingerprint, _ = s.fingerprint()
+	}
 
 	go func() {
+		defer s.Stop()
 		var (
 			ok       bool
+			update   bool
+			full     bool
 			minTimer <-chan time.Time
 			maxTimer <-chan time.Time
 		)
+		refresh := func() {
+			minTimer, maxTimer = nil, nil
+			if err := s.refresh(full); err != nil {
+				// Retry in full once the max debounce time has passed, so a
+				// failed refresh doesn't leave the stat out of date
+				select {
+				case errors <- fmt.Errorf("%v Stat.refresh(): %v", s.Name, err):
+				case <-ctx.Done():
+				}
+				full = true
+				minTimer = clock.After(max)
+				return
+			}
+			if polled {
+				latest, err := s.fingerprint()
+				unchanged := err == nil && latest == fingerprint
+				fingerprint = latest
+				if unchanged && !full {
+					return
+				}
+			}
+			s.NotifyListeners(StatEvent{Full: full})
+			full = false
+		}
 		for {
 			select {
-			case _, ok = <-updated:
+			case update, ok = <-updated:
 				if !ok {
 					return
 				}
-				minTimer = time.After(min)
+				if !update {
+					// Updates may have been missed: resync in full
+					full = true
+				}
+				minTimer = clock.After(min)
 				if maxTimer == nil {
-					maxTimer = time.After(max)
+					maxTimer = clock.After(max)
 				}
 			case <-minTimer:
-				minTimer, maxTimer = nil, nil
-				if err := s.Refresh(); err != nil {
-					errors <- fmt.Errorf("%v Stat.refresh(): %v", s.Name, err)
-					return
-				}
-				s.NotifyListeners()
+				refresh()
 			case <-maxTimer:
-				minTimer, maxTimer = nil, nil
-				if err := s.Refresh(); err != nil {
-					errors <- fmt.Errorf("%v Stat.refresh(): %v", s.Name, err)
-					return
-				}
-				s.NotifyListeners()
+				refresh()
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
 
 	return nil
 }
-
-func (s *Stat) RegisterListener(listener chan<- bool) {
-	s.Lock()
-	defer s.Unlock()
-	s.listeners = append(s.listeners, listener)
-}
-
-func (s *Stat) NotifyListeners() {
-	for _, listener := range s.listeners {
-		listener <- true
-	}
-}
@@ -0,0 +1,219 @@
+package arithmospora
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// StatEvent tells a listener that a stat has changed. Full is set if the stat
+// was resynced in full, e.g. after updates may have been missed, rather than
+// refreshed with its latest changes, and Scheduled if it changed with the
+// passage of time. Events which a listener has yet to take are coalesced into
+// one: Count gives the number of notifications merged, and Time when the
+// first was made. Changed gives the buckets which have changed, by the name
+// of their datapoint, for stats whose datapoints track their changes, e.g.
+// timed stats
+type StatEvent struct {
+	Stat      *Stat
+	Full      bool
+	Scheduled bool
+	Count     int
+	Time      time.Time
+	Changed   map[string][]int64
+}
+
+// merge coalesces a later notification into the event
+func (se *StatEvent) merge(later StatEvent) {
+	se.Full = se.Full || later.Full
+	se.Scheduled = se.Scheduled || later.Scheduled
+	se.Count += later.Count
+	if len(later.Changed) == 0 {
+		return
+	}
+	// The changes of the pending event are shared with other listeners, so
+	// merge into a copy
+	changed := make(map[string][]int64, len(se.Changed)+len(later.Changed))
+	for dpName, buckets := range se.Changed {
+		changed[dpName] = buckets
+	}
+	for dpName, buckets := range later.Changed {
+		changed[dpName] = mergeBuckets(changed[dpName], buckets)
+	}
+	se.Changed = changed
+}
+
+// mergeBuckets returns the union of two ordered lists of buckets, in order
+func mergeBuckets(buckets []int64, others []int64) []int64 {
+	merged := make([]int64, 0, len(buckets)+len(others))
+	i, j := 0, 0
+	for i < len(buckets) || j < len(others) {
+		switch {
+		case j == len(others) || (i < len(buckets) && buckets[i] < others[j]):
+			merged = append(merged, buckets[i])
+			i++
+		case i == len(buckets) || others[j] < buckets[i]:
+			merged = append(merged, others[j])
+			j++
+		default:
+			merged = append(merged, buckets[i])
+			i, j = i+1, j+1
+		}
+	}
+	return merged
+}
+
+// StatListener receives a stat's events without ever blocking the stat or
+// its other listeners: each listener holds at most one pending event, into
+// which further notifications are coalesced until the listener takes it.
+// Receive from Ready, then take the event with Next
+type StatListener struct {
+	Name      string
+	stat      *Stat
+	ready     chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+	pending   *StatEvent
+	delivered int
+	coalesced int
+	maxLag    time.Duration
+}
+
+// StatListenerStats reports how a listener is keeping up with its stat:
+// Coalesced counts notifications merged into an event already pending,
+// PendingFor how long the event now pending has waited, and MaxLag the
+// longest any event waited before being taken
+type StatListenerStats struct {
+	Name       string        `json:"name"`
+	Delivered  int           `json:"delivered"`
+	Coalesced  int           `json:"coalesced"`
+	PendingFor time.Duration `json:"pendingFor"`
+	MaxLag     time.Duration `json:"maxLag"`
+}
+
+// Listen registers a listener for the stat's events, named for its metrics,
+// until it is closed or ctx is done
+func (s *Stat) Listen(ctx context.Context, name string) *StatListener {
+	listener := &StatListener{
+		Name:   name,
+		stat:   s,
+		ready:  make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	s.listenersMu.Lock()
+	s.listeners = append(s.listeners, listener)
+	s.listenersMu.Unlock()
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				listener.Close()
+			case <-listener.closed:
+			}
+		}()
+	}
+	return listener
+}
+
+// Ready receives when an event is pending
+func (l *StatListener) Ready() <-chan struct{} {
+	return l.ready
+}
+
+// Done is closed once the listener is closed
+func (l *StatListener) Done() <-chan struct{} {
+	return l.closed
+}
+
+// Next takes the pending event, returning false if there is none
+func (l *StatListener) Next() (StatEvent, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.pending == nil {
+		return StatEvent{}, false
+	}
+	event := *l.pending
+	l.pending = nil
+	l.delivered++
+	if lag := clockOrSystem(l.stat.Clock).Now().Sub(event.Time); lag > l.maxLag {
+		l.maxLag = lag
+	}
+	return event, true
+}
+
+// Close unregisters the listener, discarding any pending event
+func (l *StatListener) Close() {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		s := l.stat
+		s.listenersMu.Lock()
+		defer s.listenersMu.Unlock()
+		for i, listener := range s.listeners {
+			if listener == l {
+				s.listeners = append(s.listeners[:i:i], s.listeners[i+1:]...)
+				break
+			}
+		}
+	})
+}
+
+func (l *StatListener) Stats() StatListenerStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := StatListenerStats{Name: l.Name, Delivered: l.delivered, Coalesced: l.coalesced, MaxLag: l.maxLag}
+	if l.pending != nil {
+		stats.PendingFor = clockOrSystem(l.stat.Clock).Now().Sub(l.pending.Time)
+	}
+	return stats
+}
+
+// notify coalesces the event into any pending event and signals readiness
+// without blocking
+func (l *StatListener) notify(event StatEvent) {
+	l.mu.Lock()
+	if l.pending == nil {
+		l.pending = &event
+	} else {
+		l.pending.merge(event)
+		l.coalesced++
+	}
+	l.mu.Unlock()
+
+	select {
+	case l.ready <- struct{}{}:
+	default:
+	}
+}
+
+// NotifyListeners sends the event to each of the stat's listeners, without
+// waiting for any to take it, along with the buckets changed since the last
+// notification
+func (s *Stat) NotifyListeners(event StatEvent) {
+	event.Stat = s
+	event.Count = 1
+	event.Time = clockOrSystem(s.Clock).Now()
+	event.Changed = s.takeChanges()
+
+	s.listenersMu.Lock()
+	listeners := append([]*StatListener(nil), s.listeners...)
+	s.listenersMu.Unlock()
+
+	for _, listener := range listeners {
+		listener.notify(event)
+	}
+}
+
+// ListenerStats returns the metrics of each of the stat's listeners
+func (s *Stat) ListenerStats() []StatListenerStats {
+	s.listenersMu.Lock()
+	listeners := append([]*StatListener(nil), s.listeners...)
+	s.listenersMu.Unlock()
+
+	stats := make([]StatListenerStats, len(listeners))
+	for i, listener := range listeners {
+		stats[i] = listener.Stats()
+	}
+	return stats
+}
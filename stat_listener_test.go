@@ -0,0 +1,73 @@
+package arithmospora
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStatListenerCoalescesChanges(t *testing.T) {
+	clock := newFakeClock(timedStatStart.Add(150 * time.Minute))
+	stat, store := newMemoryTimedStat(t, clock, []Period{{Granularity: 3600, Cycles: 3}}, 1, 2, 4)
+	hour := timedStatStart.Unix() / 3600
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	slow, prompt := stat.Listen(ctx, "slow"), stat.Listen(ctx, "prompt")
+	stat.NotifyListeners(StatEvent{Full: true})
+	slow.Next()
+	prompt.Next()
+
+	// The prompt listener takes each event as it comes, while the slow
+	// listener's are coalesced
+	updates := []struct {
+		buckets   map[int64]float64
+		event     StatEvent
+		changed   map[string][]int64
+		coalesced map[string][]int64
+	}{
+		{
+			buckets: map[int64]float64{hour + 1: 5},
+			event:   StatEvent{},
+			changed: map[string][]int64{"3600": {hour + 1}},
+		},
+		{
+			buckets: map[int64]float64{hour + 1: 7, hour + 2: 6},
+			event:   StatEvent{Scheduled: true},
+			changed: map[string][]int64{"3600": {hour + 1, hour + 2}},
+		},
+		{
+			buckets: map[int64]float64{hour + 2: 6},
+			event:   StatEvent{},
+			changed: nil,
+		},
+	}
+	for i, update := range updates {
+		for bucket, votes := range update.buckets {
+			store.SetBucket("election:stats:votes:datapoints:3600", bucket, votes)
+		}
+		if err := stat.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+		stat.NotifyListeners(update.event)
+		event, ok := prompt.Next()
+		if !ok {
+			t.Fatalf("update %d: prompt listener not notified", i)
+		}
+		if fmt.Sprint(event.Changed) != fmt.Sprint(update.changed) {
+			t.Errorf("update %d: changed %v, want %v", i, event.Changed, update.changed)
+		}
+	}
+
+	event, ok := slow.Next()
+	if !ok {
+		t.Fatal("slow listener not notified")
+	}
+	if event.Count != 3 || event.Full || !event.Scheduled {
+		t.Errorf("coalesced event %+v, want 3 scheduled notifications", event)
+	}
+	if want := map[string][]int64{"3600": {hour + 1, hour + 2}}; fmt.Sprint(event.Changed) != fmt.Sprint(want) {
+		t.Errorf("coalesced changed %v, want %v", event.Changed, want)
+	}
+}
@@ -0,0 +1,93 @@
+package arithmospora
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStat returns a proportion stat held in the store at key
+func memoryStat(store *MemoryStore, key string, updateListener StatUpdateListener) *Stat {
+	keyMaker := MemoryKeyMaker{RedisKeyMaker{RedisPrefix: key}, store}
+	return &Stat{
+		Name:            key,
+		DataLoader:      &ProportionDataLoaderMemory{keyMaker},
+		DataPointLoader: &MemoryDataPointLoader{keyMaker},
+		UpdateListener:  updateListener,
+	}
+}
+
+func TestPolledStatNotifiesOnlyOnChange(t *testing.T) {
+	store := NewMemoryStore()
+	store.SetProportion("election:stats:total", 3, 10)
+	stat := memoryStat(store, "election:stats:total", &PollUpdateListener{Interval: 10 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listener := stat.Listen(ctx, "test")
+	if err := stat.ListenForUpdates(ctx, 0, 0, make(chan error, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-listener.Ready():
+		t.Fatal("listener notified of unchanged data")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	store.SetProportion("election:stats:total", 4, 10)
+	select {
+	case <-listener.Ready():
+	case <-time.After(time.Second):
+		t.Fatal("listener not notified of changed data")
+	}
+	if event, ok := listener.Next(); !ok || event.Count != 1 {
+		t.Fatalf("got event %+v, want one notification", event)
+	}
+	select {
+	case <-listener.Ready():
+		t.Fatal("listener notified again of unchanged data")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestStatRefreshDuringReload(t *testing.T) {
+	clock := newFakeClock(timedStatStart.Add(150 * time.Minute))
+	stat, store := newMemoryTimedStat(t, clock, []Period{{Granularity: 3600, Cycles: 3}, {Granularity: 7200, Cycles: 1, Aggregate: AggregateSum}}, 1, 2, 4)
+	hour := timedStatStart.Unix() / 3600
+
+	// Run under the race detector, refreshes must not touch the datapoints
+	// a reload is replacing, nor hold up marshalling
+	var wg sync.WaitGroup
+	run := func(action func(i int) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				if err := action(i); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	run(func(i int) error {
+		store.SetBucket("election:stats:votes:datapoints:3600", hour+2, float64(i))
+		return stat.Refresh()
+	})
+	run(func(int) error { return stat.Reload() })
+	run(func(int) error {
+		_, err := json.Marshal(stat)
+		return err
+	})
+	wg.Wait()
+
+	store.SetBucket("election:stats:votes:datapoints:3600", hour+2, 100)
+	if err := stat.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if got := timedDataPoints(t, stat)["3600"][hour+2]; got != 100 {
+		t.Errorf("refreshed bucket %v, want 100", got)
+	}
+}
@@ -3,6 +3,7 @@ package arithmospora
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
@@ -10,121 +11,567 @@ import (
 
 type TimedDataLoader interface {
 	StatDataLoader
-	FetchBucket(int64) (int, error)
+	FetchBuckets([]int64) ([]Bucket, error)
 }
 
+// TimedDataBatchLoader is implemented by timed data loaders able to fetch the
+// buckets of several loaders at once, e.g. in a single round trip
+type TimedDataBatchLoader interface {
+	FetchBucketsBatch([]TimedDataLoader, [][]int64) ([][]Bucket, error)
+}
+
+// Bucket holds the values of a single time bucket, one per field of the
+// timed stat. Stats without named fields have a single value per bucket
+type Bucket []float64
+
+func (b Bucket) equal(other Bucket) bool {
+	if len(b) != len(other) {
+		return false
+	}
+	for i := range b {
+		if b[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Bucket layouts for timed stats with named fields: "hash" stores each
+// field in its own hash at <prefix>:data:<field>; "json" stores a hash at
+// <prefix>:data with each bucket's fields encoded as a JSON object
+const (
+	TimedLayoutHash = "hash"
+	TimedLayoutJSON = "json"
+)
+
+// Aggregations used to derive a period's buckets from the finest period
+// loaded from the data store
+const (
+	AggregateSum = "sum"
+	AggregateMax = "max"
+	AggregateAvg = "avg"
+)
+
+// Suffix of the datapoint providing a running total view of a period
+const CumulativeSuffix = ":cumulative"
+
+// Period defines the buckets of a timed stat. Granularity is the bucket size
+// in seconds; Cycles is the number of buckets in a moving window, or -1 for
+// the whole period from the source start time to its end time plus tail.
+// EndGrace, WholePeriodTail (both in seconds) and Timezone override the
+// source's settings for this period. If Aggregate is set, buckets are
+// derived from the finest non-aggregated period rather than loaded, and if
+// Cumulative is set, a running total view of the period is also provided.
+// Refreshes fetch the current and previous buckets, plus Backfill further
+// buckets to pick up late writes.
 type Period struct {
-	Granularity int64
-	Cycles      int64
-	BucketKeys  []int64
-	Buckets     map[int64]int
+	Granularity     int64
+	Cycles          int64
+	EndGrace        *int64
+	WholePeriodTail *int64
+	Timezone        string
+	Aggregate       string
+	Cumulative      bool
+	Backfill        int64
+	BucketKeys      []int64
+	Buckets         map[int64]Bucket
+	location        *time.Location
+}
+
+// Default timing settings, in seconds: clamp the current time to no more
+// than five minutes past the end time, and extend whole period buckets an
+// hour beyond the end time (e.g. to allow for people still in the voting
+// booth after the end of an election)
+const (
+	DefaultEndGrace        = 5 * 60
+	DefaultWholePeriodTail = 60 * 60
+)
+
+// ResolvePeriods returns a copy of periods with unset timing settings
+// inherited from the given source defaults
+func ResolvePeriods(periods []Period, endGrace *int64, wholePeriodTail *int64, timezone string) ([]Period, error) {
+	resolved := make([]Period, len(periods))
+	for i, period := range periods {
+		if period.EndGrace == nil {
+			period.EndGrace = endGrace
+		}
+		if period.WholePeriodTail == nil {
+			period.WholePeriodTail = wholePeriodTail
+		}
+		if period.Timezone == "" {
+			period.Timezone = timezone
+		}
+		if period.Timezone != "" {
+			location, err := time.LoadLocation(period.Timezone)
+			if err != nil {
+				return nil, fmt.Errorf("period %v: %v", period.Granularity, err)
+			}
+			period.location = location
+		}
+		resolved[i] = period
+	}
+
+	// Check derived periods can be aggregated from the finest period
+	finest := FinestPeriod(resolved)
+	for _, period := range resolved {
+		switch period.Aggregate {
+		case "":
+			continue
+		case AggregateSum, AggregateMax, AggregateAvg:
+		default:
+			return nil, fmt.Errorf("period %v: invalid aggregate %q: must be one of %s, %s, %s", period.Granularity, period.Aggregate, AggregateSum, AggregateMax, AggregateAvg)
+		}
+		if finest == nil || period.Granularity <= finest.Granularity || period.Granularity%finest.Granularity != 0 {
+			return nil, fmt.Errorf("period %v: aggregated periods must be a multiple of a finer period which is not aggregated", period.Granularity)
+		}
+	}
+	return resolved, nil
+}
+
+// FinestPeriod returns the period with the smallest granularity which is
+// loaded rather than aggregated, or nil if there is none
+func FinestPeriod(periods []Period) *Period {
+	var finest *Period
+	for i, period := range periods {
+		if period.Aggregate == "" && period.Granularity > 0 && (finest == nil || period.Granularity < finest.Granularity) {
+			finest = &periods[i]
+		}
+	}
+	return finest
+}
+
+// DataPointName returns the name of the timed stat datapoint for this
+// period, which is its granularity
+func (p *Period) DataPointName() string {
+	return fmt.Sprintf("%v", p.Granularity)
+}
+
+func (p *Period) endGrace() time.Duration {
+	if p.EndGrace == nil {
+		return DefaultEndGrace * time.Second
+	}
+	return time.Duration(*p.EndGrace) * time.Second
+}
+
+func (p *Period) wholePeriodTail() time.Duration {
+	if p.WholePeriodTail == nil {
+		return DefaultWholePeriodTail * time.Second
+	}
+	return time.Duration(*p.WholePeriodTail) * time.Second
+}
+
+// offset returns the timezone offset in seconds at the given time, used to
+// align buckets to local rather than UTC boundaries
+func (p *Period) offset(t time.Time) int64 {
+	if p.location == nil {
+		return 0
+	}
+	_, offset := t.In(p.location).Zone()
+	return int64(offset)
+}
+
+// BucketFor returns the key of the bucket containing the given time. Buckets
+// are aligned to multiples of the granularity in the period's timezone, so
+// e.g. daily buckets start at local midnight
+func (p *Period) BucketFor(t time.Time) int64 {
+	secs := t.Unix() + p.offset(t)
+	bucket := secs / p.Granularity
+	if secs%p.Granularity < 0 {
+		bucket--
+	}
+	return bucket
+}
+
+// BucketStart returns the start time of the given bucket: the earliest time
+// in it, or for a bucket skipped when clocks go forward, the start of the
+// next. Daily buckets start at local midnight. Sub-day buckets start at the
+// bucket's local time less the UTC offset either side of any clock change,
+// so a bucket repeated when clocks go back starts at its first occurrence
+func (p *Period) BucketStart(bucket int64) time.Time {
+	local := bucket * p.Granularity
+	if p.location == nil {
+		return time.Unix(local, 0)
+	}
+	if p.Granularity%(24*60*60) == 0 {
+		day := time.Unix(local, 0).UTC()
+		return time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, p.location)
+	}
+	var start time.Time
+	for _, offset := range []int64{p.offset(time.Unix(local-24*60*60, 0)), p.offset(time.Unix(local+24*60*60, 0))} {
+		candidate := time.Unix(local-offset, 0)
+		if p.BucketFor(candidate) >= bucket && (start.IsZero() || candidate.Before(start)) {
+			start = candidate
+		}
+	}
+	return start
+}
+
+// fineBucketKeys returns the keys of the buckets of the finer period which
+// fall within the given bucket
+func (p *Period) fineBucketKeys(bucket int64, fine *Period) []int64 {
+	start := fine.BucketFor(p.BucketStart(bucket))
+	end := fine.BucketFor(p.BucketStart(bucket + 1))
+	keys := make([]int64, 0, end-start)
+	for key := start; key < end; key++ {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// aggregate derives the given buckets of the period from the buckets of the
+// finer period, which must cover the keys returned by fineBucketKeys for each
+// bucket in turn. Averages are taken over the fine buckets started by now
+func (p *Period) aggregate(keys []int64, fine *Period, fineBuckets []Bucket, fieldCount int, now time.Time) []Bucket {
+	currentFine := fine.BucketFor(now)
+	buckets := make([]Bucket, len(keys))
+	offset := 0
+	for i, key := range keys {
+		buckets[i] = make(Bucket, fieldCount)
+		elapsed := 0
+		fineRange := p.fineBucketKeys(key, fine)
+		for j, fineKey := range fineRange {
+			if fineKey <= currentFine {
+				elapsed++
+			}
+			for index, value := range fineBuckets[offset+j] {
+				switch p.Aggregate {
+				case AggregateMax:
+					if j == 0 || value > buckets[i][index] {
+						buckets[i][index] = value
+					}
+				default:
+					buckets[i][index] += value
+				}
+			}
+		}
+		if p.Aggregate == AggregateAvg && elapsed > 0 {
+			for index := range buckets[i] {
+				buckets[i][index] /= float64(elapsed)
+			}
+		}
+		offset += len(fineRange)
+	}
+	return buckets
+}
+
+// Now returns the current time pegged at no further than the end grace
+// beyond the given end time
+func (p *Period) Now(clock Clock, endTime time.Time) time.Time {
+	currentTime := clockOrSystem(clock).Now()
+	if pegged := endTime.Add(p.endGrace()); currentTime.After(pegged) {
+		currentTime = pegged
+	}
+	return currentTime
 }
 
 type TimedData struct {
 	StartTime  time.Time
 	EndTime    time.Time
+	Fields     []string
+	Cumulative bool
 	Period     *Period
+	periods    []Period
 	dataLoader TimedDataLoader
+	clock      Clock
+	changed    map[int64]bool
+}
+
+// NextRefresh returns the time at which the next moving window period moves
+// along a bucket, for the parent stat of the periods, which refreshes them
+// all. Moving windows stop moving at the end time plus grace
+func (td *TimedData) NextRefresh(now time.Time) (next time.Time) {
+	if td.Period.Granularity != 0 {
+		return time.Time{}
+	}
+	for i := range td.periods {
+		period := &td.periods[i]
+		if period.Cycles <= 0 {
+			continue
+		}
+		boundary := period.BucketStart(period.BucketFor(now) + 1)
+		if boundary.After(td.EndTime.Add(period.endGrace())) {
+			continue
+		}
+		if next.IsZero() || boundary.Before(next) {
+			next = boundary
+		}
+	}
+	return next
+}
+
+// values returns the bucket values for the given keys, as running totals
+// from the start of the period if the data is a cumulative view
+func (td *TimedData) values(keys []int64) []Bucket {
+	if !td.Cumulative {
+		values := make([]Bucket, len(keys))
+		for i, key := range keys {
+			values[i] = td.Period.Buckets[key]
+		}
+		return values
+	}
+
+	totals := make(map[int64]Bucket, len(td.Period.BucketKeys))
+	var total Bucket
+	for _, key := range td.Period.BucketKeys {
+		bucket := td.Period.Buckets[key]
+		if total == nil {
+			total = make(Bucket, len(bucket))
+		}
+		running := make(Bucket, len(total))
+		for index := range total {
+			total[index] += bucket[index]
+			running[index] = total[index]
+		}
+		totals[key] = running
+	}
+	values := make([]Bucket, len(keys))
+	for i, key := range keys {
+		values[i] = totals[key]
+	}
+	return values
+}
+
+// marshalBuckets encodes the given buckets: stats without named fields as an
+// object of bucket values keyed by bucket, and stats with named fields in
+// columnar form: {"buckets":[<key>,...],"series":{"<field>":[<value>,...]}}
+func (td *TimedData) marshalBuckets(keys []int64) ([]byte, error) {
+	values := td.values(keys)
+	if len(td.Fields) == 0 {
+		buckets := make(map[int64]float64, len(values))
+		for i, key := range keys {
+			buckets[key] = values[i][0]
+		}
+		return json.Marshal(buckets)
+	}
+
+	series := make(map[string][]float64, len(td.Fields))
+	for index, field := range td.Fields {
+		fieldValues := make([]float64, len(values))
+		for i := range values {
+			fieldValues[i] = values[i][index]
+		}
+		series[field] = fieldValues
+	}
+	return json.Marshal(struct {
+		Buckets []int64              `json:"buckets"`
+		Series  map[string][]float64 `json:"series"`
+	}{keys, series})
 }
 
 func (td *TimedData) MarshalJSON() ([]byte, error) {
 	if td.Period.Granularity == 0 {
 		return []byte("{}"), nil
 	}
-	return json.Marshal(td.Period.Buckets)
+	return td.marshalBuckets(td.Period.BucketKeys)
+}
+
+// MarshalDeltaJSON encodes only the given changed buckets, in the same form
+// as MarshalJSON. Cumulative views send every bucket from the earliest
+// change onwards, as all later totals change too. Buckets leaving a moving
+// window are not sent: clients should discard buckets more than the window's
+// cycles before the latest bucket.
+func (td *TimedData) MarshalDeltaJSON(changed []int64) ([]byte, error) {
+	if td.Period.Granularity == 0 {
+		return []byte("{}"), nil
+	}
+	changedKeys := make(map[int64]bool, len(changed))
+	for _, key := range changed {
+		changedKeys[key] = true
+	}
+	var keys []int64
+	changedFrom := false
+	for _, key := range td.Period.BucketKeys {
+		if changedKeys[key] || (td.Cumulative && changedFrom) {
+			keys = append(keys, key)
+			changedFrom = true
+		}
+	}
+	return td.marshalBuckets(keys)
+}
+
+// TakeChangedBuckets returns the buckets which have changed since the last
+// call, in order
+func (td *TimedData) TakeChangedBuckets() []int64 {
+	var keys []int64
+	for _, key := range td.Period.BucketKeys {
+		if td.changed[key] {
+			keys = append(keys, key)
+		}
+	}
+	td.changed = nil
+	return keys
 }
 
 func (td *TimedData) String() string {
 	return fmt.Sprintf("%v (%s)", td.Period, td.dataLoader)
 }
 
-func (td *TimedData) Refresh() error {
-	// If granularity = zero then we have no data so nothing to do
-	if td.Period.Granularity == 0 {
-		return nil
+// refreshKeys returns the bucket window the period should cover now and the
+// keys which need fetching to bring it up to date: the current and previous
+// buckets plus the period's backfill, any buckets newly entering a moving
+// window, or every bucket if full is set
+func (td *TimedData) refreshKeys(full bool) (start int64, end int64, keys []int64) {
+	period := td.Period
+	currentBucket := period.BucketFor(period.Now(td.clock, td.EndTime))
+	start, end = period.BucketKeys[0], period.BucketKeys[len(period.BucketKeys)-1]
+	if period.Cycles > 0 && currentBucket > end {
+		start, end = currentBucket-period.Cycles, currentBucket
 	}
 
-	// Determine current time:, peg at no further than 5 minutes beyond end time
-	// TODO: make configurable
-	currentTime := time.Now()
-	if currentTime.After(td.EndTime.Add(5 * time.Minute)) {
-		currentTime = td.EndTime.Add(5 * time.Minute)
+	from := currentBucket - 1 - period.Backfill
+	for key := start; key <= end; key++ {
+		_, ok := period.Buckets[key]
+		if full || !ok || (key >= from && key <= currentBucket) {
+			keys = append(keys, key)
+		}
 	}
+	return start, end, keys
+}
 
-	// Fetch current and previous buckets if within time range
-	currentBucket := currentTime.Unix() / td.Period.Granularity
-	previousBucket := currentBucket - 1
-	startBucket := td.Period.BucketKeys[0]
-
-	if currentBucket >= startBucket {
-		newCurrent, err := td.dataLoader.FetchBucket(currentBucket)
-		if err != nil {
-			return fmt.Errorf("%v: %v", currentBucket, err)
+// applyRefresh stores fetched buckets, recording which have changed, and
+// moves the window to cover start to end
+func (td *TimedData) applyRefresh(start int64, end int64, keys []int64, buckets []Bucket) {
+	period := td.Period
+	if td.changed == nil {
+		td.changed = make(map[int64]bool)
+	}
+	for i, key := range keys {
+		if old, ok := period.Buckets[key]; !ok || !old.equal(buckets[i]) {
+			td.changed[key] = true
 		}
-		td.Period.Buckets[currentBucket] = newCurrent
+		period.Buckets[key] = buckets[i]
 	}
 
-	if previousBucket >= startBucket {
-		newPrevious, err := td.dataLoader.FetchBucket(previousBucket)
-		if err != nil {
-			return fmt.Errorf("%v: %v", previousBucket, err)
+	if start == period.BucketKeys[0] && end == period.BucketKeys[len(period.BucketKeys)-1] {
+		return
+	}
+	period.BucketKeys = make([]int64, 0, end-start+1)
+	for key := start; key <= end; key++ {
+		period.BucketKeys = append(period.BucketKeys, key)
+	}
+	for key := range period.Buckets {
+		if key < start || key > end {
+			delete(period.Buckets, key)
+			delete(td.changed, key)
 		}
-		td.Period.Buckets[previousBucket] = newPrevious
 	}
+}
 
-	// If we're a moving window and have acquired a new bucket, discard the
-	// oldest bucket
-	if td.Period.Cycles > 0 && int64(len(td.Period.Buckets)) > td.Period.Cycles+1 {
-		delete(td.Period.Buckets, td.Period.BucketKeys[0])
-		td.Period.BucketKeys = append(td.Period.BucketKeys[1:], currentBucket)
+func (td *TimedData) refresh(full bool) error {
+	// If granularity = zero then we have no data so nothing to do
+	if td.Period.Granularity == 0 {
+		return nil
 	}
 
+	start, end, keys := td.refreshKeys(full)
+	if len(keys) == 0 {
+		return nil
+	}
+	buckets, err := td.dataLoader.FetchBuckets(keys)
+	if err != nil {
+		return fmt.Errorf("%v: %v", keys, err)
+	}
+	td.applyRefresh(start, end, keys, buckets)
 	return nil
 }
 
-type TimedDataLoaderRedis struct {
-	RedisKeyMaker
-	StartTime time.Time
-	EndTime   time.Time
-	Periods   []Period
+func (td *TimedData) Refresh() error {
+	return td.refresh(false)
 }
 
-func (tdl *TimedDataLoaderRedis) FetchBucket(bucket int64) (int, error) {
-	conn := RedisPool().Get()
-	defer conn.Close()
+// Backfill refetches every bucket in the period, picking up late writes to
+// buckets older than those fetched by Refresh
+func (td *TimedData) Backfill() error {
+	return td.refresh(true)
+}
 
-	data, err := redis.Int(conn.Do("HGET", tdl.MakeKey("data"), fmt.Sprintf("%v", bucket)))
-	if err != nil && err != redis.ErrNil {
-		return 0, err
+// RefreshDataPoints refreshes the periods of a parent timed stat together,
+// in a single batch if the loader supports it. Each period's datapoint is
+// locked while its keys are worked out and again while its buckets are
+// applied, but not while they are fetched
+func (td *TimedData) RefreshDataPoints(dataPoints []*Stat, full bool) error {
+	var (
+		children []*Stat
+		data     []*TimedData
+		loaders  []TimedDataLoader
+		starts   []int64
+		ends     []int64
+		keys     [][]int64
+	)
+	for _, dp := range dataPoints {
+		dp.Lock()
+		child, ok := dp.data.(*TimedData)
+		if !ok || child.Period.Granularity == 0 {
+			dp.Unlock()
+			continue
+		}
+		start, end, childKeys := child.refreshKeys(full)
+		dp.Unlock()
+		if len(childKeys) == 0 {
+			continue
+		}
+		children = append(children, dp)
+		data = append(data, child)
+		loaders = append(loaders, child.dataLoader)
+		starts = append(starts, start)
+		ends = append(ends, end)
+		keys = append(keys, childKeys)
+	}
+	if len(children) == 0 {
+		return nil
 	}
-	return data, nil
-}
 
-func (tdl *TimedDataLoaderRedis) Load(stat *Stat) (StatData, error) {
-	conn := RedisPool().Get()
-	defer conn.Close()
+	var (
+		buckets [][]Bucket
+		err     error
+	)
+	if batchLoader, ok := td.dataLoader.(TimedDataBatchLoader); ok {
+		buckets, err = batchLoader.FetchBucketsBatch(loaders, keys)
+		if err != nil {
+			return err
+		}
+	} else {
+		buckets = make([][]Bucket, len(loaders))
+		for i, loader := range loaders {
+			if buckets[i], err = loader.FetchBuckets(keys[i]); err != nil {
+				return fmt.Errorf("%v: %v", keys[i], err)
+			}
+		}
+	}
 
+	for i, dp := range children {
+		dp.Lock()
+		// A reload while fetching replaces the datapoint's data, which is
+		// then loaded afresh
+		if dp.data == StatData(data[i]) {
+			data[i].applyRefresh(starts[i], ends[i], keys[i], buckets[i])
+		}
+		dp.Unlock()
+	}
+	return nil
+}
+
+// loadTimedData constructs the timed data for a stat: for a period datapoint,
+// all the buckets of the period named by the stat are loaded
+func loadTimedData(stat *Stat, tdl TimedDataLoader, clock Clock, startTime time.Time, endTime time.Time, fields []string, periods []Period) (*TimedData, error) {
 	timedData := TimedData{
-		StartTime:  tdl.StartTime,
-		EndTime:    tdl.EndTime,
+		StartTime:  startTime,
+		EndTime:    endTime,
+		Fields:     fields,
+		Cumulative: strings.HasSuffix(stat.Name, CumulativeSuffix),
 		Period:     &Period{},
+		periods:    periods,
 		dataLoader: tdl,
-	}
-
-	// Determine current time:, peg at no further than 5 minutes beyond end time
-	// TODO: make configurable
-	currentTime := time.Now()
-	if currentTime.After(tdl.EndTime.Add(5 * time.Minute)) {
-		currentTime = tdl.EndTime.Add(5 * time.Minute)
+		clock:      clock,
 	}
 
 	// Loop through periods and construct if period matches the datapoint being loaded
-	for _, period := range tdl.Periods {
-		if fmt.Sprintf("%v", period.Granularity) != stat.Name {
+	for _, period := range periods {
+		if period.DataPointName() != strings.TrimSuffix(stat.Name, CumulativeSuffix) {
 			continue
 		}
 
-		period.Buckets = make(map[int64]int)
+		period.Buckets = make(map[int64]Bucket)
 
 		// Determine start and end buckets
 		var (
@@ -133,102 +580,268 @@ func (tdl *TimedDataLoaderRedis) Load(stat *Stat) (StatData, error) {
 		)
 		if period.Cycles < 0 {
 			// Whole period: start bucket is start time, end bucket is end time
-			// plus one hour (e.g. to allow for people still in voting booth
-			// after end of election)
-			startBucket = tdl.StartTime.Unix() / period.Granularity
-			endBucket = tdl.EndTime.Add(1*time.Hour).Unix() / period.Granularity
+			// plus the whole period tail
+			startBucket = period.BucketFor(startTime)
+			endBucket = period.BucketFor(endTime.Add(period.wholePeriodTail()))
 		} else {
 			// Moving window based on current time
-			endBucket = currentTime.Unix() / period.Granularity
+			endBucket = period.BucketFor(period.Now(clock, endTime))
 			startBucket = endBucket - period.Cycles
 		}
 
-		// Create Buckets with zero values and build list of keys
+		// Build list of keys
 		period.BucketKeys = make([]int64, endBucket-startBucket+1)
 		index := 0
 		for key := startBucket; key <= endBucket; key++ {
-			period.Buckets[key] = 0
 			period.BucketKeys[index] = key
 			index++
 		}
 
-		// Load data from redis
-		dataKey := tdl.MakeKey("data")
-		if period.Cycles < 0 {
-			// Whole period: Load all data with HGETALL
-			data, err := redis.IntMap(conn.Do("HGETALL", dataKey))
+		// Load all values in range
+		buckets, err := tdl.FetchBuckets(period.BucketKeys)
+		if err != nil {
+			return nil, err
+		}
+		for index, key := range period.BucketKeys {
+			period.Buckets[key] = buckets[index]
+		}
+
+		// Assign period to stat
+		timedData.Period = &period
+
+		// Period found and contructed - No need to progress further through the loop
+		break
+	}
+
+	return &timedData, nil
+}
+
+type TimedDataLoaderRedis struct {
+	RedisPoolKeyMaker
+	StartTime  time.Time
+	EndTime    time.Time
+	Fields     []string
+	Layout     string
+	Periods    []Period
+	Clock      Clock
+	derived    *derivedPeriod
+	fineLoader *TimedDataLoaderRedis
+}
+
+// derivedPeriod aggregates a period's buckets from the buckets of a finer
+// period
+type derivedPeriod struct {
+	period Period
+	fine   Period
+}
+
+// timedDataPoint returns the name of the period datapoint whose data backs a
+// timed stat's datapoint: cumulative views share the data of their period.
+// For a derived period, the period from which it is aggregated is also
+// returned, whose datapoint holds the data
+func timedDataPoint(periods []Period, dpName string) (string, *derivedPeriod) {
+	dpName = strings.TrimSuffix(dpName, CumulativeSuffix)
+	for _, period := range periods {
+		if period.DataPointName() != dpName || period.Aggregate == "" {
+			continue
+		}
+		if finest := FinestPeriod(periods); finest != nil {
+			return dpName, &derivedPeriod{period: period, fine: *finest}
+		}
+		break
+	}
+	return dpName, nil
+}
+
+// fineKeys returns the keys of the fine buckets covering the given buckets
+func (dp *derivedPeriod) fineKeys(keys []int64) (fineKeys []int64) {
+	for _, key := range keys {
+		fineKeys = append(fineKeys, dp.period.fineBucketKeys(key, &dp.fine)...)
+	}
+	return fineKeys
+}
+
+// buckets derives the given buckets from the fine buckets returned for
+// fineKeys, as at the current time pegged to the end time
+func (dp *derivedPeriod) buckets(keys []int64, fineBuckets []Bucket, fieldCount int, clock Clock, endTime time.Time) []Bucket {
+	return dp.period.aggregate(keys, &dp.fine, fineBuckets, fieldCount, dp.period.Now(clock, endTime))
+}
+
+// timedFieldCount returns the number of values in each bucket of a timed
+// stat with the given fields
+func timedFieldCount(fields []string) int {
+	if len(fields) == 0 {
+		return 1
+	}
+	return len(fields)
+}
+
+// pendingBuckets receives the replies to a pipelined bucket fetch
+type pendingBuckets func() ([]Bucket, error)
+
+// sendFetchBuckets pipelines the commands to load the given buckets,
+// aggregating them from a finer period if the period is derived
+func (tdl *TimedDataLoaderRedis) sendFetchBuckets(conn redis.Conn, keys []int64) pendingBuckets {
+	if tdl.derived == nil {
+		return tdl.sendFetchStoredBuckets(conn, keys)
+	}
+
+	receiveFine := tdl.fineLoader.sendFetchStoredBuckets(conn, tdl.derived.fineKeys(keys))
+	return func() ([]Bucket, error) {
+		fineBuckets, err := receiveFine()
+		if err != nil {
+			return nil, err
+		}
+		return tdl.derived.buckets(keys, fineBuckets, timedFieldCount(tdl.Fields), tdl.Clock, tdl.EndTime), nil
+	}
+}
+
+// sendFetchStoredBuckets pipelines the commands to load the given buckets
+// according to the stat's layout. Missing buckets and fields are zero
+func (tdl *TimedDataLoaderRedis) sendFetchStoredBuckets(conn redis.Conn, keys []int64) pendingBuckets {
+	hmget := func(hashKey string) []interface{} {
+		args := make([]interface{}, len(keys)+1)
+		args[0] = hashKey
+		for i, key := range keys {
+			args[i+1] = fmt.Sprintf("%v", key)
+		}
+		return args
+	}
+
+	var sendErr error
+	if len(tdl.Fields) == 0 || tdl.Layout == TimedLayoutJSON {
+		sendErr = conn.Send("HMGET", hmget(tdl.MakeKey("data"))...)
+	} else {
+		for _, field := range tdl.Fields {
+			if err := conn.Send("HMGET", hmget(tdl.MakeKey("data", field))...); err != nil && sendErr == nil {
+				sendErr = err
+			}
+		}
+	}
+
+	return func() ([]Bucket, error) {
+		if sendErr != nil {
+			return nil, sendErr
+		}
+		buckets := make([]Bucket, len(keys))
+		for i := range buckets {
+			buckets[i] = make(Bucket, timedFieldCount(tdl.Fields))
+		}
+
+		switch {
+		case len(tdl.Fields) == 0:
+			values, err := redis.Float64s(conn.Receive())
 			if err != nil {
 				return nil, err
 			}
-			for _, key := range period.BucketKeys {
-				period.Buckets[key] = data[fmt.Sprintf("%v", key)]
-			}
-		} else {
-			// Moving window: Load all values in range with HMGET
-			redisArgs := make([]interface{}, len(period.BucketKeys)+1)
-			redisArgs[0] = dataKey
-			for index, key := range period.BucketKeys {
-				redisArgs[index+1] = fmt.Sprintf("%v", key)
+			for i, value := range values {
+				buckets[i][0] = value
 			}
-			data, err := redis.Ints(conn.Do("HMGET", redisArgs...))
+		case tdl.Layout == TimedLayoutJSON:
+			values, err := redis.ByteSlices(conn.Receive())
 			if err != nil {
 				return nil, err
 			}
-			for index, key := range period.BucketKeys {
-				period.Buckets[key] = data[index]
+			for i, value := range values {
+				if value == nil {
+					continue
+				}
+				fields := make(map[string]float64)
+				if err := json.Unmarshal(value, &fields); err != nil {
+					return nil, fmt.Errorf("bucket %v: %v", keys[i], err)
+				}
+				for index, field := range tdl.Fields {
+					buckets[i][index] = fields[field]
+				}
+			}
+		default:
+			var fieldErr error
+			for index := range tdl.Fields {
+				// Receive every reply even after an error to keep the
+				// connection's pipeline in step
+				values, err := redis.Float64s(conn.Receive())
+				if err != nil {
+					if fieldErr == nil {
+						fieldErr = err
+					}
+					continue
+				}
+				for i, value := range values {
+					buckets[i][index] = value
+				}
+			}
+			if fieldErr != nil {
+				return nil, fieldErr
 			}
-
 		}
+		return buckets, nil
+	}
+}
 
-		// Assign period to stat
-		timedData.Period = &period
+func (tdl *TimedDataLoaderRedis) FetchBuckets(keys []int64) ([]Bucket, error) {
+	conn := tdl.Pool.Get()
+	defer conn.Close()
 
-		// Period found and contructed - No need to progress further through the loop
-		break
+	receive := tdl.sendFetchBuckets(conn, keys)
+	if err := conn.Flush(); err != nil {
+		return nil, err
 	}
+	return receive()
+}
 
-	// If we don't have a granularity, then we're in the parent stat
-	// Set up a ticker to force refresh the stat (and by extension the
-	// children) every time a moving window child stat move along a bucket
-	if timedData.Period.Granularity == 0 {
-		ticker := time.NewTicker(time.Second)
-		go func() {
-			for {
-				currentTime := <-ticker.C
-				// Cancel the ticker if we're past the end time + 5 minutes
-				if currentTime.After(tdl.EndTime.Add(5 * time.Minute)) {
-					ticker.Stop()
-					return
-				}
+// FetchBucketsBatch fetches the buckets of several loaders with a single
+// pipelined round trip
+func (tdl *TimedDataLoaderRedis) FetchBucketsBatch(loaders []TimedDataLoader, keys [][]int64) ([][]Bucket, error) {
+	conn := tdl.Pool.Get()
+	defer conn.Close()
 
-				for _, period := range tdl.Periods {
-					if period.Cycles > 0 && currentTime.Unix()%period.Granularity == 0 {
-						// Publish stat update through Redis - ignore errors
-						conn := RedisPool().Get()
-						_, _ = conn.Do("PUBLISH", tdl.MakeKey("updates"), 1)
-						conn.Close()
-
-						// Break out of the loop, as we only need to publish
-						// once irrespective of the number of moving window
-						// children entering a new time bucket
-						break
-					}
-				}
-			}
-		}()
+	pending := make([]pendingBuckets, len(loaders))
+	for i, loader := range loaders {
+		redisLoader, ok := loader.(*TimedDataLoaderRedis)
+		if !ok {
+			return nil, fmt.Errorf("%s: cannot batch with non-redis loader %s", tdl, loader)
+		}
+		pending[i] = redisLoader.sendFetchBuckets(conn, keys[i])
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
 	}
 
-	return &timedData, nil
+	buckets := make([][]Bucket, len(loaders))
+	var batchErr error
+	for i, receive := range pending {
+		var err error
+		if buckets[i], err = receive(); err != nil && batchErr == nil {
+			batchErr = fmt.Errorf("%s %v: %v", loaders[i], keys[i], err)
+		}
+	}
+	if batchErr != nil {
+		return nil, batchErr
+	}
+	return buckets, nil
+}
+
+func (tdl *TimedDataLoaderRedis) Load(stat *Stat) (StatData, error) {
+	return loadTimedData(stat, tdl, tdl.Clock, tdl.StartTime, tdl.EndTime, tdl.Fields, tdl.Periods)
 }
 
 type TimedDataPointLoaderRedis struct {
-	RedisKeyMaker
+	RedisPoolKeyMaker
 	Periods []Period
 }
 
-func (tdplr *TimedDataPointLoaderRedis) DataPointNames() (dpNames []string, err error) {
-	for _, period := range tdplr.Periods {
-		dpNames = append(dpNames, fmt.Sprintf("%v", period.Granularity))
+func (tdplr *TimedDataPointLoaderRedis) DataPointNames() ([]string, error) {
+	return timedDataPointNames(tdplr.Periods), nil
+}
+
+// timedDataPointNames returns the datapoint names of a timed stat: one per
+// period, plus the cumulative view of those periods which have one
+func timedDataPointNames(periods []Period) (dpNames []string) {
+	for _, period := range periods {
+		dpNames = append(dpNames, period.DataPointName())
+		if period.Cumulative {
+			dpNames = append(dpNames, period.DataPointName()+CumulativeSuffix)
+		}
 	}
 	return
 }
@@ -239,14 +852,87 @@ func (tdplr *TimedDataPointLoaderRedis) NewDataLoader(sdl StatDataLoader, dpName
 		return nil
 	}
 
-	return &TimedDataLoaderRedis{
-		RedisKeyMaker: RedisKeyMaker{RedisPrefix: tdplr.MakeKey("datapoints", dpName)},
-		StartTime:     tdl.StartTime,
-		EndTime:       tdl.EndTime,
-		Periods:       tdl.Periods,
+	dpName, derived := timedDataPoint(tdl.Periods, dpName)
+	dpLoader := &TimedDataLoaderRedis{
+		RedisPoolKeyMaker: RedisPoolKeyMaker{RedisKeyMaker{RedisPrefix: tdplr.MakeKey("datapoints", dpName)}, tdl.Pool},
+		StartTime:         tdl.StartTime,
+		EndTime:           tdl.EndTime,
+		Fields:            tdl.Fields,
+		Layout:            tdl.Layout,
+		Periods:           tdl.Periods,
+		Clock:             tdl.Clock,
+	}
+
+	if derived != nil {
+		fineLoader := *dpLoader
+		fineLoader.RedisKeyMaker = RedisKeyMaker{RedisPrefix: tdplr.MakeKey("datapoints", derived.fine.DataPointName())}
+		dpLoader.derived, dpLoader.fineLoader = derived, &fineLoader
 	}
+	return dpLoader
 }
 
 func (tdplr *TimedDataPointLoaderRedis) NewDataPointLoader(dpName string) StatDataPointLoader {
-	return &TimedDataPointLoaderRedis{RedisKeyMaker{RedisPrefix: tdplr.MakeKey("datapoints", dpName)}, nil}
+	return &TimedDataPointLoaderRedis{RedisPoolKeyMaker{RedisKeyMaker{RedisPrefix: tdplr.MakeKey("datapoints", dpName)}, tdplr.Pool}, nil}
+}
+
+type TimedDataLoaderMemory struct {
+	MemoryKeyMaker
+	StartTime  time.Time
+	EndTime    time.Time
+	Fields     []string
+	Periods    []Period
+	Clock      Clock
+	derived    *derivedPeriod
+	fineLoader *TimedDataLoaderMemory
+}
+
+// FetchBuckets returns the buckets set in the store, aggregating them from a
+// finer period if the period is derived. Missing buckets and fields are zero
+func (tdl *TimedDataLoaderMemory) FetchBuckets(keys []int64) ([]Bucket, error) {
+	if tdl.derived == nil {
+		return tdl.Store.fetchBuckets(tdl.MakeKey(), keys, timedFieldCount(tdl.Fields)), nil
+	}
+	fineBuckets, _ := tdl.fineLoader.FetchBuckets(tdl.derived.fineKeys(keys))
+	return tdl.derived.buckets(keys, fineBuckets, timedFieldCount(tdl.Fields), tdl.Clock, tdl.EndTime), nil
+}
+
+func (tdl *TimedDataLoaderMemory) Load(stat *Stat) (StatData, error) {
+	return loadTimedData(stat, tdl, tdl.Clock, tdl.StartTime, tdl.EndTime, tdl.Fields, tdl.Periods)
+}
+
+type TimedDataPointLoaderMemory struct {
+	MemoryKeyMaker
+	Periods []Period
+}
+
+func (tdplm *TimedDataPointLoaderMemory) DataPointNames() ([]string, error) {
+	return timedDataPointNames(tdplm.Periods), nil
+}
+
+func (tdplm *TimedDataPointLoaderMemory) NewDataLoader(sdl StatDataLoader, dpName string) StatDataLoader {
+	tdl, ok := sdl.(*TimedDataLoaderMemory)
+	if !ok {
+		return nil
+	}
+
+	dpName, derived := timedDataPoint(tdl.Periods, dpName)
+	dpLoader := &TimedDataLoaderMemory{
+		MemoryKeyMaker: MemoryKeyMaker{RedisKeyMaker{RedisPrefix: tdplm.MakeKey("datapoints", dpName)}, tdplm.Store},
+		StartTime:      tdl.StartTime,
+		EndTime:        tdl.EndTime,
+		Fields:         tdl.Fields,
+		Periods:        tdl.Periods,
+		Clock:          tdl.Clock,
+	}
+
+	if derived != nil {
+		fineLoader := *dpLoader
+		fineLoader.RedisKeyMaker = RedisKeyMaker{RedisPrefix: tdplm.MakeKey("datapoints", derived.fine.DataPointName())}
+		dpLoader.derived, dpLoader.fineLoader = derived, &fineLoader
+	}
+	return dpLoader
+}
+
+func (tdplm *TimedDataPointLoaderMemory) NewDataPointLoader(dpName string) StatDataPointLoader {
+	return &TimedDataPointLoaderMemory{MemoryKeyMaker{RedisKeyMaker{RedisPrefix: tdplm.MakeKey("datapoints", dpName)}, tdplm.Store}, nil}
 }
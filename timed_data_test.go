@@ -0,0 +1,198 @@
+package arithmospora
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBucketStartClockChanges(t *testing.T) {
+	periods, err := ResolvePeriods([]Period{{Granularity: 60 * 60}, {Granularity: 24 * 60 * 60}}, nil, nil, "Europe/London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hourly, daily := &periods[0], &periods[1]
+	utc := func(value string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	tests := []struct {
+		name   string
+		period *Period
+		at     string
+		start  string
+	}{
+		// Clocks go back at 01:00 UTC on 25 October 2026, repeating the
+		// local hour from 01:00, which is one bucket starting at its first
+		// occurrence
+		{"hour before fall back", hourly, "2026-10-24T23:30:00Z", "2026-10-24T23:00:00Z"},
+		{"repeated hour, first", hourly, "2026-10-25T00:30:00Z", "2026-10-25T00:00:00Z"},
+		{"repeated hour, second", hourly, "2026-10-25T01:30:00Z", "2026-10-25T00:00:00Z"},
+		{"hour after fall back", hourly, "2026-10-25T02:30:00Z", "2026-10-25T02:00:00Z"},
+		{"day of fall back", daily, "2026-10-25T12:00:00Z", "2026-10-24T23:00:00Z"},
+		{"day after fall back", daily, "2026-10-26T12:00:00Z", "2026-10-26T00:00:00Z"},
+		// Clocks go forward at 01:00 UTC on 29 March 2026
+		{"hour before spring forward", hourly, "2026-03-29T00:30:00Z", "2026-03-29T00:00:00Z"},
+		{"hour after spring forward", hourly, "2026-03-29T01:30:00Z", "2026-03-29T01:00:00Z"},
+		{"day of spring forward", daily, "2026-03-29T12:00:00Z", "2026-03-29T00:00:00Z"},
+		{"day after spring forward", daily, "2026-03-30T12:00:00Z", "2026-03-29T23:00:00Z"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			at := utc(test.at)
+			bucket := test.period.BucketFor(at)
+			start := test.period.BucketStart(bucket)
+			if !start.Equal(utc(test.start)) {
+				t.Errorf("BucketStart(BucketFor(%s)) = %s, want %s", test.at, start.UTC().Format(time.RFC3339), test.start)
+			}
+			if got := test.period.BucketFor(start); got != bucket {
+				t.Errorf("BucketFor(%s) = %v, want %v", start.UTC().Format(time.RFC3339), got, bucket)
+			}
+			if next := test.period.BucketStart(bucket + 1); !at.Before(next) {
+				t.Errorf("next bucket starts at %s, not after %s", next.UTC().Format(time.RFC3339), test.at)
+			}
+		})
+	}
+}
+
+// timedDataPoints returns the buckets of each datapoint of a timed stat, or
+// of a delta of one, without named fields, as sent to clients
+func timedDataPoints(t *testing.T, stat json.Marshaler) map[string]map[int64]float64 {
+	t.Helper()
+	encoded, err := json.Marshal(stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		DataPoints map[string]struct {
+			Data map[int64]float64 `json:"data"`
+		} `json:"dataPoints"`
+	}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	dataPoints := make(map[string]map[int64]float64)
+	for dpName, dp := range decoded.DataPoints {
+		dataPoints[dpName] = dp.Data
+	}
+	return dataPoints
+}
+
+// timedStatStart is the start time of the source of stats made by
+// newMemoryTimedStat
+var timedStatStart = time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+
+// newMemoryTimedStat returns a loaded memory timed stat, votes, of a source
+// running for three hours from timedStatStart with the given periods, and
+// the store holding it. The hourly buckets from the start hold the votes
+func newMemoryTimedStat(t *testing.T, clock Clock, periods []Period, votes ...float64) (*Stat, *MemoryStore) {
+	t.Helper()
+	sourceConfig := SourceConfig{
+		Name: "election", RedisPrefix: "election", StartTime: timedStatStart, EndTime: timedStatStart.Add(3 * time.Hour),
+		TimedStatPeriods: periods,
+	}
+	source := &Source{Name: "election", Clock: clock}
+	stat := source.MakeStatFromConfig(sourceConfig, StatConfig{Name: "votes", DataType: "timed", LoaderType: "memory"})
+	hour := timedStatStart.Unix() / 3600
+	for i, value := range votes {
+		source.MemoryStore.SetBucket("election:stats:votes:datapoints:3600", hour+int64(i), value)
+	}
+	if err := stat.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	return stat, source.MemoryStore
+}
+
+func TestTimedDataMemoryLoader(t *testing.T) {
+	start := timedStatStart
+	clock := newFakeClock(start.Add(150 * time.Minute))
+	stat, store := newMemoryTimedStat(t, clock, []Period{{Granularity: 3600, Cycles: 3, Cumulative: true}, {Granularity: 7200, Cycles: 1, Aggregate: AggregateSum}}, 1, 2, 4)
+	hour, twoHours := start.Unix()/3600, start.Unix()/7200
+
+	want := map[string]map[int64]float64{
+		"3600":            {hour - 1: 0, hour: 1, hour + 1: 2, hour + 2: 4},
+		"3600:cumulative": {hour - 1: 0, hour: 1, hour + 1: 3, hour + 2: 7},
+		"7200":            {twoHours: 3, twoHours + 1: 4},
+	}
+	if got := timedDataPoints(t, stat); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("loaded %v, want %v", got, want)
+	}
+
+	// Moving the clock on moves the windows along on refresh
+	clock.Set(start.Add(190 * time.Minute))
+	store.SetBucket("election:stats:votes:datapoints:3600", hour+3, 8)
+	if err := stat.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]map[int64]float64{
+		"3600":            {hour: 1, hour + 1: 2, hour + 2: 4, hour + 3: 8},
+		"3600:cumulative": {hour: 1, hour + 1: 3, hour + 2: 7, hour + 3: 15},
+		"7200":            {twoHours: 3, twoHours + 1: 12},
+	}
+	if got := timedDataPoints(t, stat); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("after an hour refreshed %v, want %v", got, want)
+	}
+}
+
+func TestTimedDataDeltaOfEvent(t *testing.T) {
+	start := timedStatStart
+	clock := newFakeClock(start.Add(150 * time.Minute))
+	stat, store := newMemoryTimedStat(t, clock, []Period{{Granularity: 3600, Cycles: 3, Cumulative: true}}, 1, 2, 4)
+	hour := start.Unix() / 3600
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listener := stat.Listen(ctx, "test")
+
+	// The delta holds the buckets changed by both refreshes, and every later
+	// running total
+	store.SetBucket("election:stats:votes:datapoints:3600", hour+2, 5)
+	clock.Set(start.Add(190 * time.Minute))
+	for i := 0; i < 2; i++ {
+		if err := stat.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+		stat.NotifyListeners(StatEvent{})
+		store.SetBucket("election:stats:votes:datapoints:3600", hour+3, 8)
+	}
+	event, ok := listener.Next()
+	if !ok {
+		t.Fatal("listener not notified")
+	}
+	want := map[string]map[int64]float64{
+		"3600":            {hour + 2: 5, hour + 3: 8},
+		"3600:cumulative": {hour + 2: 8, hour + 3: 16},
+	}
+	if got := timedDataPoints(t, stat.Delta(event.Changed)); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("delta %v, want %v", got, want)
+	}
+}
+
+func TestPeriodNowPeggedToEndTime(t *testing.T) {
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(3 * time.Hour)
+	endGrace := int64(10 * 60)
+	tests := []struct {
+		name   string
+		period Period
+		now    time.Time
+		want   time.Time
+	}{
+		{"before end", Period{Granularity: 3600}, start.Add(time.Hour), start.Add(time.Hour)},
+		{"within default grace", Period{Granularity: 3600}, end.Add(time.Minute), end.Add(time.Minute)},
+		{"beyond default grace", Period{Granularity: 3600}, end.Add(time.Hour), end.Add(DefaultEndGrace * time.Second)},
+		{"beyond set grace", Period{Granularity: 3600, EndGrace: &endGrace}, end.Add(time.Hour), end.Add(10 * time.Minute)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.period.Now(newFakeClock(test.now), end); !got.Equal(test.want) {
+				t.Errorf("Now() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package arithmospora
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// upstreamTimeout is how long to wait to connect to an upstream server,
+	// or for it to send anything, even a ping, before reconnecting
+	upstreamTimeout = 90 * time.Second
+
+	// upstreamSyncTimeout bounds how long publishing a source waits for the
+	// initial data of its upstream stats
+	upstreamSyncTimeout = 30 * time.Second
+
+	// upstreamRetryMax bounds the delay between attempts to reconnect
+	upstreamRetryMax = 30 * time.Second
+)
+
+// UpstreamClient follows a source served by another Arithmospora server as a
+// websocket client, receiving the same messages as any other client. The
+// stats received are written to a memory store, from which stats with
+// loader_type "upstream" are served as memory stats, so their datapoints and
+// milestones work as for stats loaded locally. The client reconnects whenever
+// the connection is lost, resyncing from the initial data sent on connect
+type UpstreamClient struct {
+	URL   string
+	Store *MemoryStore
+	stats map[string]upstreamStat
+}
+
+// upstreamStat is a stat followed from upstream, written to the store at key
+type upstreamStat struct {
+	key      string
+	dataType string
+	fields   []string
+}
+
+func NewUpstreamClient(url string, store *MemoryStore) *UpstreamClient {
+	return &UpstreamClient{URL: url, Store: store, stats: make(map[string]upstreamStat)}
+}
+
+// Follow registers a stat, given by its key within its group, e.g. total or
+// 5m:total, to be written to the store at key. Stats must be registered
+// before the client is started
+func (uc *UpstreamClient) Follow(statKey string, key string, dataType string, fields []string) {
+	uc.stats[statKey] = upstreamStat{key, dataType, fields}
+}
+
+// Start connects to the upstream server, returning once the initial data of
+// every followed stat has been received. The client then follows the
+// upstream until ctx is done, reporting problems on errors
+func (uc *UpstreamClient) Start(ctx context.Context, errors chan<- error) error {
+	synced := make(chan struct{})
+	go uc.run(ctx, synced, errors)
+	select {
+	case <-synced:
+		return nil
+	case <-time.After(upstreamSyncTimeout):
+		return fmt.Errorf("upstream %s: no initial data after %v", uc.URL, upstreamSyncTimeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (uc *UpstreamClient) run(ctx context.Context, synced chan struct{}, errors chan<- error) {
+	var syncOnce sync.Once
+	report := func(err error) {
+		select {
+		case errors <- fmt.Errorf("upstream %s: %v", uc.URL, err):
+		case <-ctx.Done():
+		}
+	}
+
+	retry := time.Second
+	for {
+		received, err := uc.follow(ctx, func() { syncOnce.Do(func() { close(synced) }) }, report)
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		if received {
+			retry = time.Second
+		}
+		report(fmt.Errorf("%v: reconnecting in %v", err, retry))
+		select {
+		case <-time.After(retry):
+		case <-ctx.Done():
+			return
+		}
+		if retry *= 2; retry > upstreamRetryMax {
+			retry = upstreamRetryMax
+		}
+	}
+}
+
+// follow connects to the upstream server and writes the stats it sends to
+// the store until the connection fails, returning whether any were received.
+// synced is called once the initial data of every followed stat has arrived
+func (uc *UpstreamClient) follow(ctx context.Context, synced func(), report func(error)) (received bool, err error) {
+	dialer := websocket.Dialer{HandshakeTimeout: upstreamTimeout}
+	conn, _, err := dialer.DialContext(ctx, uc.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	// The server pings periodically, so a silent connection has been lost
+	conn.SetReadDeadline(time.Now().Add(upstreamTimeout))
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(upstreamTimeout))
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(upstreamTimeout))
+		if netErr, ok := err.(net.Error); err == websocket.ErrCloseSent || (ok && netErr.Temporary()) {
+			return nil
+		}
+		return err
+	})
+
+	// Followed stats yet to receive their initial data
+	var pending map[string]bool
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return received, err
+		}
+		conn.SetReadDeadline(time.Now().Add(upstreamTimeout))
+		envelope, err := parseEnvelope(message)
+		if err != nil {
+			report(err)
+			continue
+		}
+
+		switch {
+		case envelope.Event == "available":
+			var available map[string][]string
+			if err := json.Unmarshal(envelope.Payload, &available); err != nil {
+				report(fmt.Errorf("invalid available message: %v", err))
+				continue
+			}
+			pending = uc.pending(available, report)
+			conn.SetWriteDeadline(time.Now().Add(upstreamTimeout))
+			if err := conn.WriteJSON(uc.readyMessage(available)); err != nil {
+				return received, err
+			}
+		case strings.HasPrefix(envelope.Event, "stats:"):
+			statKey := upstreamStatKey(envelope.Event)
+			stat, ok := uc.stats[statKey]
+			if !ok {
+				continue
+			}
+			var snapshotStat SnapshotStat
+			if err := json.Unmarshal(envelope.Payload, &snapshotStat); err != nil {
+				report(fmt.Errorf("%s: %v", envelope.Event, err))
+				continue
+			}
+			snapshotStat.Store(uc.Store, stat.key, stat.dataType, stat.fields)
+			uc.Store.Update(stat.key)
+			received = true
+		default:
+			continue
+		}
+
+		if pending != nil {
+			delete(pending, upstreamStatKey(envelope.Event))
+			if len(pending) == 0 {
+				synced()
+				pending = nil
+			}
+		}
+	}
+}
+
+// pending returns the followed stats which the upstream says are available,
+// reporting any which are not
+func (uc *UpstreamClient) pending(available map[string][]string, report func(error)) map[string]bool {
+	offered := make(map[string]bool)
+	for _, statKeys := range available {
+		for _, statKey := range statKeys {
+			offered[statKey] = true
+		}
+	}
+	pending := make(map[string]bool)
+	for statKey := range uc.stats {
+		if offered[statKey] {
+			pending[statKey] = true
+		} else {
+			report(fmt.Errorf("stat %s is not available upstream", statKey))
+		}
+	}
+	return pending
+}
+
+// readyMessage returns the ready message subscribing to the followed stats
+func (uc *UpstreamClient) readyMessage(available map[string][]string) Message {
+	subscriptions := make(map[string][]string)
+	for statGroup, statKeys := range available {
+		for _, statKey := range statKeys {
+			if _, ok := uc.stats[statKey]; ok {
+				subscriptions[statGroup] = append(subscriptions[statGroup], statKey)
+			}
+		}
+	}
+	return Message{Version: ProtocolVersion, Event: "ready", Payload: ReadyRequest{Subscriptions: subscriptions}}
+}
+
+// upstreamStatKey returns the key within its group of the stat sent by an
+// event, e.g. 5m:total for stats:rolling:5m:total, or votes for a delta
+// event stats:timed:votes:delta
+func upstreamStatKey(event string) string {
+	parts := strings.SplitN(event, ":", 3)
+	if len(parts) != 3 {
+		return ""
+	}
+	if parts[1] == "timed" {
+		return strings.TrimSuffix(parts[2], ":delta")
+	}
+	return parts[2]
+}
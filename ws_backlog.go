@@ -0,0 +1,271 @@
+package arithmospora
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Policies for clients whose send buffer is full, set by slow_client_policy
+// in the websocket config. Under SlowClientDisconnect messages are held in
+// order, but only for the grace period: with no grace period the client is
+// disconnected at once. Under SlowClientDropOldest only the latest message
+// for each stat is held, and under SlowClientSnapshot stat messages are
+// dropped in favour of a single snapshot of every stat, sent in place of the
+// latest. Other messages, such as milestones, are always held in order.
+// Messages sent in place of others are numbered as the latest they replace
+const (
+	SlowClientDisconnect = "disconnect"
+	SlowClientDropOldest = "drop_oldest"
+	SlowClientSnapshot   = "snapshot"
+)
+
+// Reasons for which clients are disconnected, sent to the client in its close
+// message and counted by the hub
+const (
+	DisconnectClosed   = "connection closed"
+	DisconnectSlow     = "send buffer full"
+	DisconnectGrace    = "slow beyond grace period"
+	DisconnectBacklog  = "too many messages held"
+	DisconnectShutdown = "server shutting down"
+	DisconnectError    = "server error"
+)
+
+// maxBacklog bounds the number of messages held for a slow client
+const maxBacklog = 256
+
+// backlogFlushInterval is how often a shard retries sending held messages to
+// slow clients
+const backlogFlushInterval = 100 * time.Millisecond
+
+// closeCode returns the websocket close code sent to a client disconnected
+// for the given reason
+func closeCode(reason string) int {
+	switch reason {
+	case DisconnectShutdown:
+		return websocket.CloseGoingAway
+	case DisconnectSlow, DisconnectGrace, DisconnectBacklog:
+		return websocket.CloseTryAgainLater
+	case DisconnectError:
+		return websocket.CloseInternalServerErr
+	}
+	return websocket.CloseNormalClosure
+}
+
+// broadcastMessage is a message being fanned out to a shard's clients,
+// numbered seq, whose event is parsed only if a slow client needs it
+type broadcastMessage struct {
+	seq    uint64
+	data   []byte
+	event  string
+	parsed bool
+}
+
+func (bm *broadcastMessage) Event() string {
+	if !bm.parsed {
+		var envelope struct {
+			Event string `json:"event"`
+		}
+		json.Unmarshal(bm.data, &envelope)
+		bm.event, bm.parsed = envelope.Event, true
+	}
+	return bm.event
+}
+
+// snapshotEvent is the event of the message sending every stat in full
+const snapshotEvent = "snapshot"
+
+// backlogEntry is a message held for a slow client, numbered seq. Stat
+// messages are held under their stat's full event, or under snapshotEvent
+// for SlowClientSnapshot. An entry without a message stands in for the
+// initial data, if initial is set, the stat in full, as for a held delta, or
+// the snapshot, which are prepared away from the shard once the entry is
+// reached
+type backlogEntry struct {
+	seq       uint64
+	statEvent string
+	message   []byte
+	initial   bool
+	preparing bool
+}
+
+// clientBacklog holds the messages for a client whose send buffer has
+// filled, from since until the buffer has room for them all, in order
+type clientBacklog struct {
+	since   time.Time
+	entries []*backlogEntry
+	stats   map[string]*backlogEntry
+}
+
+// hold adds the message to the backlog as per the policy, returning false if
+// the backlog is full. A stat's held message is replaced by moving it to the
+// back, so that messages are sent in sequence, unless it is being prepared
+func (cb *clientBacklog) hold(policy string, message *broadcastMessage) bool {
+	event := message.Event()
+	entry := &backlogEntry{seq: message.seq, message: message.data}
+	if policy != SlowClientDisconnect && strings.HasPrefix(event, "stats:") {
+		entry.statEvent = event
+		if policy == SlowClientSnapshot {
+			entry.statEvent, entry.message = snapshotEvent, nil
+		} else if strings.HasSuffix(event, ":delta") {
+			entry.statEvent, entry.message = strings.TrimSuffix(event, ":delta"), nil
+		}
+		if held, ok := cb.stats[entry.statEvent]; ok && !held.preparing {
+			cb.drop(held)
+		}
+		cb.stats[entry.statEvent] = entry
+	}
+	cb.entries = append(cb.entries, entry)
+	return len(cb.entries) <= maxBacklog
+}
+
+// drop removes a held message from the backlog
+func (cb *clientBacklog) drop(entry *backlogEntry) {
+	cb.replace(entry, nil)
+}
+
+// replace puts the given entries in place of a held entry
+func (cb *clientBacklog) replace(entry *backlogEntry, entries []*backlogEntry) {
+	for i, held := range cb.entries {
+		if held == entry {
+			cb.entries = append(cb.entries[:i], append(entries, cb.entries[i+1:]...)...)
+			break
+		}
+	}
+	if cb.stats[entry.statEvent] == entry {
+		delete(cb.stats, entry.statEvent)
+	}
+}
+
+// deliver sends a broadcast message to a client, holding it as per the
+// hub's slow client policy if the client is behind
+func (hs *hubShard) deliver(client *Client, message *broadcastMessage) {
+	if !client.wants(message) {
+		return
+	}
+	config := hs.hub.config
+	if client.backlog == nil {
+		select {
+		case client.send <- message.data:
+			return
+		default:
+		}
+		if config.SlowClientPolicy == SlowClientDisconnect && config.SlowClientGrace == 0 {
+			hs.remove(client, DisconnectSlow)
+			return
+		}
+		hs.startBacklog(client)
+	}
+	if !client.backlog.hold(config.SlowClientPolicy, message) {
+		hs.remove(client, DisconnectBacklog)
+		return
+	}
+	hs.flush(client)
+}
+
+// startBacklog holds the messages for a client from now on
+func (hs *hubShard) startBacklog(client *Client) {
+	client.backlog = &clientBacklog{since: time.Now(), stats: make(map[string]*backlogEntry)}
+	hs.backlogged[client] = true
+}
+
+// flush sends a slow client's held messages while its buffer has room,
+// releasing the backlog once all are sent. Sending stops at a message yet to
+// be prepared until it is ready. A client left behind for longer than the
+// grace period, if set, is disconnected
+func (hs *hubShard) flush(client *Client) {
+	backlog := client.backlog
+	sent := 0
+	for _, entry := range backlog.entries {
+		if entry.message == nil {
+			if !entry.preparing {
+				entry.preparing = true
+				hs.prepare(client, entry)
+			}
+			break
+		}
+		select {
+		case client.send <- entry.message:
+			sent++
+			continue
+		default:
+		}
+		break
+	}
+
+	for _, entry := range backlog.entries[:sent] {
+		if backlog.stats[entry.statEvent] == entry {
+			delete(backlog.stats, entry.statEvent)
+		}
+	}
+	backlog.entries = backlog.entries[sent:]
+	if len(backlog.entries) == 0 {
+		client.backlog = nil
+		delete(hs.backlogged, client)
+		return
+	}
+
+	grace := time.Duration(hs.hub.config.SlowClientGrace) * time.Second
+	if grace > 0 && time.Since(backlog.since) > grace {
+		hs.remove(client, DisconnectGrace)
+	}
+}
+
+// preparedMessage is a message marshalled for a held entry of a client's
+// backlog, or the messages of the initial data
+type preparedMessage struct {
+	client   *Client
+	entry    *backlogEntry
+	message  []byte
+	messages [][]byte
+	err      error
+}
+
+// prepare marshals what a held entry stands in for in its own goroutine, as
+// marshalling takes the stats' locks, and hands it back to the shard
+func (hs *hubShard) prepare(client *Client, entry *backlogEntry) {
+	source, statEvent, initial := hs.hub.source, entry.statEvent, entry.initial
+	go func() {
+		prepared := preparedMessage{client: client, entry: entry}
+		switch {
+		case initial:
+			prepared.messages = source.initialData()
+		case statEvent == snapshotEvent:
+			prepared.message, prepared.err = source.snapshotMessage()
+		default:
+			prepared.message, prepared.err = source.statMessage(statEvent)
+		}
+		select {
+		case hs.prepared <- prepared:
+		case <-hs.hub.done:
+		}
+	}()
+}
+
+// handlePrepared fills in a held entry with its prepared message, numbered
+// as the entry, and carries on sending the client's held messages. The
+// initial data takes the place of its entry, as per the client's
+// subscriptions, and entries which can't be marshalled are dropped
+func (hs *hubShard) handlePrepared(prepared preparedMessage) {
+	client, entry := prepared.client, prepared.entry
+	if !hs.clients[client] || client.backlog == nil {
+		return
+	}
+	entry.preparing = false
+	if entry.initial {
+		var entries []*backlogEntry
+		for _, message := range prepared.messages {
+			if client.wants(&broadcastMessage{data: message}) {
+				entries = append(entries, &backlogEntry{seq: entry.seq, message: message})
+			}
+		}
+		client.backlog.replace(entry, entries)
+	} else if prepared.err != nil {
+		client.backlog.drop(entry)
+	} else {
+		entry.message = stampSeq(prepared.message, entry.seq)
+	}
+	hs.flush(client)
+}
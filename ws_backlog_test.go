@@ -0,0 +1,93 @@
+package arithmospora
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSlowClientMessagesInSequence(t *testing.T) {
+	clock := newFakeClock(timedStatStart.Add(150 * time.Minute))
+	stat, _ := newMemoryTimedStat(t, clock, []Period{{Granularity: 3600, Cycles: 3}}, 1, 2, 4)
+	source := &Source{Name: "election", Stats: map[string]map[string]*Stat{"timed": {"votes": stat}}}
+
+	// Each round updates the stat in full and by delta, with a notice
+	// between, so that every policy holds some messages and replaces others
+	var messages [][]byte
+	for i := 0; i < 8; i++ {
+		for _, event := range []string{"stats:timed:votes", "notice", "stats:timed:votes:delta"} {
+			message, err := json.Marshal(Message{Event: event, Payload: i})
+			if err != nil {
+				t.Fatal(err)
+			}
+			messages = append(messages, message)
+		}
+	}
+	end, err := json.Marshal(Message{Event: "end"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, policy := range []string{SlowClientDisconnect, SlowClientDropOldest, SlowClientSnapshot} {
+		t.Run(policy, func(t *testing.T) {
+			hub := NewHub(source, WebsocketConfig{Shards: 1, SlowClientPolicy: policy, SlowClientGrace: 60})
+			shard := hub.shards[0]
+			client := &Client{hub: hub, shard: shard, send: make(chan []byte, 2), closed: make(chan struct{}), ready: true}
+			shard.clients[client] = true
+			ctx, cancel := context.WithCancel(context.Background())
+			defer func() {
+				cancel()
+				<-hub.done
+			}()
+			go hub.Run(ctx)
+
+			for _, message := range messages {
+				hub.broadcast(message)
+			}
+			hub.broadcast(end)
+
+			var seq uint64
+			var events []string
+			for {
+				var data []byte
+				select {
+				case message, ok := <-client.send:
+					if !ok {
+						t.Fatalf("client disconnected as %q", client.reason)
+					}
+					data = message
+				case <-time.After(2 * time.Second):
+					t.Fatalf("end not received after %v", events)
+				}
+				var message Message
+				if err := json.Unmarshal(data, &message); err != nil {
+					t.Fatal(err)
+				}
+				events = append(events, message.Event)
+				if message.Seq <= seq {
+					t.Fatalf("%s seq %d after seq %d, having received %v", message.Event, message.Seq, seq, events)
+				}
+				seq = message.Seq
+				if message.Event == "end" {
+					break
+				}
+			}
+			if policy != SlowClientDisconnect && len(events) > len(messages) {
+				t.Errorf("received %d messages, want fewer than the %d broadcast", len(events), len(messages)+1)
+			}
+			if want := policy == SlowClientSnapshot; contains(events, snapshotEvent) != want {
+				t.Errorf("received %v, want snapshot %v", events, want)
+			}
+		})
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package arithmospora
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// ProtocolVersion is the version of the client protocol spoken by the
+// server, sent in the envelope of the available message. Clients give the
+// version they speak in the envelope of their ready message, so that later
+// versions can change messages for the clients which ask for them. Clients
+// which send no ready message speak version 1, the original protocol
+const ProtocolVersion = 2
+
+// defaultReadyTimeoutMs is how long the server waits for a client's ready
+// message unless ready_timeout_ms is set in the websocket config
+const defaultReadyTimeoutMs = 500
+
+// maxClientMessage bounds the size of messages read from clients
+const maxClientMessage = 64 * 1024
+
+// ReadyRequest is the payload of the ready message a client sends once it
+// has processed the available message, upon which it is sent the initial
+// data. Subscriptions, in the form of the available message's payload,
+// limits the stats the client is sent to those given: by default it is sent
+// every stat. Clients may send ready again to change their subscriptions,
+// and a resuming client may send it straight away to restore them
+type ReadyRequest struct {
+	Subscriptions map[string][]string `json:"subscriptions"`
+}
+
+// clientReady tells a shard that a client is ready, with the client's
+// request and protocol version, or that it has not said so in time, when
+// request is nil
+type clientReady struct {
+	client  *Client
+	version int
+	request *ReadyRequest
+}
+
+// awaitReady sends a new client the available message, numbered seq, then
+// waits for the client to say it is ready before sending the initial data.
+// Clients which don't, speaking the original protocol, are sent it after the
+// ready timeout. Clients which can't be sent the available message are
+// disconnected, without holding up the shard
+func (hs *hubShard) awaitReady(client *Client, seq uint64) {
+	available, err := hs.hub.source.availableMessage(seq)
+	if err != nil {
+		hs.remove(client, DisconnectError)
+		go func() {
+			select {
+			case client.errors <- err:
+			case <-hs.hub.done:
+			}
+		}()
+		return
+	}
+	hs.deliver(client, &broadcastMessage{data: available})
+	if !hs.clients[client] {
+		return
+	}
+	timeout := time.Duration(hs.hub.config.ReadyTimeoutMs) * time.Millisecond
+	client.readyTimer = time.AfterFunc(timeout, func() {
+		select {
+		case hs.ready <- clientReady{client: client}:
+		case <-hs.hub.done:
+		}
+	})
+}
+
+// handleReady applies a client's ready request and, the first time it is
+// ready, sends it the initial data as per its subscriptions. The initial
+// data is prepared away from the shard, with the messages broadcast
+// meanwhile held behind it
+func (hs *hubShard) handleReady(ready clientReady) {
+	client := ready.client
+	if !hs.clients[client] {
+		return
+	}
+	if ready.request != nil {
+		client.version = ready.version
+		client.subscriptions = ready.request.subscriptions()
+	}
+	if client.ready {
+		return
+	}
+	client.ready = true
+	if client.readyTimer != nil {
+		client.readyTimer.Stop()
+	}
+	if client.backlog == nil {
+		hs.startBacklog(client)
+	}
+	client.backlog.entries = append(client.backlog.entries, &backlogEntry{seq: hs.lastSeq, initial: true})
+	hs.flush(client)
+}
+
+// subscriptions returns the full events of the stats subscribed to, or nil
+// for every stat
+func (rr *ReadyRequest) subscriptions() map[string]bool {
+	if rr.Subscriptions == nil {
+		return nil
+	}
+	subscriptions := make(map[string]bool)
+	for statGroup, statKeys := range rr.Subscriptions {
+		for _, statKey := range statKeys {
+			subscriptions["stats:"+statGroup+":"+statKey] = true
+		}
+	}
+	return subscriptions
+}
+
+// wants returns whether a broadcast message should be sent to the client.
+// Stat messages are sent only once the client is ready, as it is then sent
+// every stat in full, and only for the stats it subscribes to
+func (c *Client) wants(message *broadcastMessage) bool {
+	if c.ready && c.subscriptions == nil {
+		return true
+	}
+	event := message.Event()
+	if !strings.HasPrefix(event, "stats:") {
+		return true
+	}
+	return c.ready && c.subscriptions[strings.TrimSuffix(event, ":delta")]
+}
+
+// readMessage handles a message from the client, returning false if the hub
+// has stopped. Messages other than ready are ignored
+func (c *Client) readMessage(message []byte) bool {
+	envelope, err := parseEnvelope(message)
+	if err != nil || envelope.Event != "ready" {
+		return true
+	}
+	request := &ReadyRequest{}
+	if len(envelope.Payload) > 0 && string(envelope.Payload) != "null" {
+		if err := json.Unmarshal(envelope.Payload, request); err != nil {
+			return true
+		}
+	}
+	select {
+	case c.shard.ready <- clientReady{client: c, version: envelope.Version, request: request}:
+		return true
+	case <-c.hub.done:
+		return false
+	}
+}
@@ -0,0 +1,98 @@
+package arithmospora
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestAwaitReadyDoesNotBlockOnFullClient(t *testing.T) {
+	hub := NewHub(&Source{Name: "election"}, WebsocketConfig{Shards: 1})
+	shard := hub.shards[0]
+	client := &Client{hub: hub, shard: shard, send: make(chan []byte, 1), closed: make(chan struct{})}
+	client.send <- []byte(`{}`)
+	shard.clients[client] = true
+
+	returned := make(chan struct{})
+	go func() {
+		shard.awaitReady(client, hub.seq)
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("awaitReady blocked on a client with a full send buffer")
+	}
+	if shard.clients[client] || client.reason != DisconnectSlow {
+		t.Errorf("client left connected with reason %q, want disconnected as %q", client.reason, DisconnectSlow)
+	}
+	if client.readyTimer != nil {
+		t.Error("ready timer started for a disconnected client")
+	}
+}
+
+// nextEvent returns the event of the next message sent to a client
+func nextEvent(t *testing.T, client *Client) string {
+	t.Helper()
+	select {
+	case data, ok := <-client.send:
+		if !ok {
+			t.Fatalf("client disconnected as %q", client.reason)
+		}
+		var message Message
+		if err := json.Unmarshal(data, &message); err != nil {
+			t.Fatal(err)
+		}
+		return message.Event
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message sent to client")
+	}
+	return ""
+}
+
+func TestReadyClientDoesNotHoldUpShard(t *testing.T) {
+	clock := newFakeClock(timedStatStart.Add(150 * time.Minute))
+	stat, _ := newMemoryTimedStat(t, clock, []Period{{Granularity: 3600, Cycles: 3}}, 1, 2, 4)
+	source := &Source{Name: "election", Stats: map[string]map[string]*Stat{"timed": {"votes": stat}}}
+	hub := NewHub(source, WebsocketConfig{Shards: 1})
+	shard := hub.shards[0]
+	observer := &Client{hub: hub, shard: shard, send: make(chan []byte, clientSendBuffer), closed: make(chan struct{}), ready: true}
+	shard.clients[observer] = true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		<-hub.done
+	}()
+	go hub.Run(ctx)
+
+	client := &Client{hub: hub, shard: shard, send: make(chan []byte, clientSendBuffer), closed: make(chan struct{})}
+	shard.register <- client
+	if event := nextEvent(t, client); event != "available" {
+		t.Fatalf("first message %s, want available", event)
+	}
+
+	// While the stat is locked, as by a refresh, the shard carries on
+	// broadcasting as the client's initial data waits
+	notice, err := json.Marshal(Message{Event: "notice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat.Lock()
+	shard.ready <- clientReady{client: client, version: ProtocolVersion, request: &ReadyRequest{}}
+	hub.broadcast(notice)
+	select {
+	case <-observer.send:
+		stat.Unlock()
+	case <-time.After(2 * time.Second):
+		stat.Unlock()
+		t.Fatal("shard held up preparing the initial data")
+	}
+
+	// The client is sent the initial data, then what was broadcast meanwhile
+	for _, want := range []string{"stats:timed:votes", "notice"} {
+		if event := nextEvent(t, client); event != want {
+			t.Fatalf("client sent %s, want %s", event, want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package arithmospora
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultReplayBuffer is the number of broadcast messages held for resuming
+// clients unless replay_buffer is set in the websocket config
+const defaultReplayBuffer = 256
+
+// clientSendBuffer is the number of messages buffered for sending to each
+// client. Resuming clients which missed more messages than this are sent the
+// initial data instead
+const clientSendBuffer = 256
+
+// firstSeq returns the sequence number preceding a new hub's first message:
+// the time in microseconds, so numbers keep increasing across restarts and
+// stay exactly representable in JavaScript
+func firstSeq() uint64 {
+	return uint64(time.Now().UnixNano() / int64(time.Microsecond))
+}
+
+// hubBroadcast is a message broadcast by a hub, with its sequence number
+type hubBroadcast struct {
+	seq  uint64
+	data []byte
+}
+
+// replayBuffer holds a hub's most recent broadcast messages, oldest first
+// from start, in a ring
+type replayBuffer struct {
+	mu      sync.Mutex
+	entries []hubBroadcast
+	start   int
+	size    int
+}
+
+func newReplayBuffer(capacity int) *replayBuffer {
+	return &replayBuffer{entries: make([]hubBroadcast, capacity)}
+}
+
+// add holds a message, dropping the oldest if the buffer is full
+func (rb *replayBuffer) add(message hubBroadcast) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if len(rb.entries) == 0 {
+		return
+	}
+	if rb.size < len(rb.entries) {
+		rb.entries[(rb.start+rb.size)%len(rb.entries)] = message
+		rb.size++
+		return
+	}
+	rb.entries[rb.start] = message
+	rb.start = (rb.start + 1) % len(rb.entries)
+}
+
+// between returns the messages numbered after since up to and including
+// until, returning false if any are no longer held or until precedes since
+func (rb *replayBuffer) between(since uint64, until uint64) ([][]byte, bool) {
+	if since > until {
+		return nil, false
+	}
+	if since == until {
+		return nil, true
+	}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.size == 0 || rb.entries[rb.start].seq > since+1 {
+		return nil, false
+	}
+	var messages [][]byte
+	for i := 0; i < rb.size; i++ {
+		entry := rb.entries[(rb.start+i)%len(rb.entries)]
+		if entry.seq > until {
+			break
+		}
+		if entry.seq > since {
+			messages = append(messages, entry.data)
+		}
+	}
+	return messages, true
+}
+
+// seqField opens a message with its sequence number, as marshalled from
+// Message
+var seqField = []byte(`{"seq":`)
+
+// stampSeq returns the message, marshalled from Message, numbered seq in
+// place of any sequence number it already has, as when relaying a message
+// from another server
+func stampSeq(message []byte, seq uint64) []byte {
+	if len(message) == 0 || message[0] != '{' {
+		return message
+	}
+	rest := message[1:]
+	if bytes.HasPrefix(message, seqField) {
+		end := bytes.IndexAny(message[len(seqField):], ",}")
+		if end < 0 {
+			return message
+		}
+		rest = message[len(seqField)+end:]
+		if rest[0] == ',' {
+			rest = rest[1:]
+		}
+	}
+	stamped := make([]byte, 0, len(seqField)+20+1+len(rest))
+	stamped = append(stamped, seqField...)
+	stamped = strconv.AppendUint(stamped, seq, 10)
+	if len(rest) > 0 && rest[0] != '}' {
+		stamped = append(stamped, ',')
+	}
+	return append(stamped, rest...)
+}
+
+// resume sends a client reconnecting with ?since=<seq>, the sequence number
+// of the last message it received, the messages it missed up to the last the
+// shard has delivered. It returns false if they can't all be sent, e.g. as
+// they are no longer held or were broadcast before a restart, when the
+// client must be sent the initial data instead
+func (hs *hubShard) resume(client *Client) bool {
+	if client.since == 0 {
+		return false
+	}
+	messages, ok := hs.hub.replay.between(client.since, hs.lastSeq)
+	if !ok || len(messages) > cap(client.send)-len(client.send) {
+		return false
+	}
+	for _, message := range messages {
+		client.send <- message
+	}
+	return true
+}
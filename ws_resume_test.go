@@ -0,0 +1,136 @@
+package arithmospora
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// resumeServer serves a source with one memory stat from a hub with a single
+// shard, so that a client's receipt of a message shows the shard has
+// delivered it, and the given replay buffer
+func resumeServer(t *testing.T, replayBuffer int) *Server {
+	t.Helper()
+	config := memoryServerConfig(StatGroupConfig{Proportion: []StatConfig{{Name: "total", LoaderType: "memory"}}})
+	config.Websocket = WebsocketConfig{Shards: 1, ReplayBuffer: replayBuffer}
+	server, _ := startServer(t, config)
+	return server
+}
+
+func dialResume(t *testing.T, server *Server, since uint64) *websocket.Conn {
+	t.Helper()
+	url := "ws://" + server.Addr().String() + "/election"
+	if since != 0 {
+		url += fmt.Sprintf("?since=%d", since)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readMessage(t *testing.T, conn *websocket.Conn) Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var message Message
+	if err := json.Unmarshal(data, &message); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+// connectReady connects a new client and takes it through the handshake,
+// returning the sequence number of the available message
+func connectReady(t *testing.T, server *Server) (*websocket.Conn, uint64) {
+	t.Helper()
+	conn := dialResume(t, server, 0)
+	available := readMessage(t, conn)
+	if available.Event != "available" {
+		t.Fatalf("first message %s, want available", available.Event)
+	}
+	if err := conn.WriteJSON(Message{Version: ProtocolVersion, Event: "ready"}); err != nil {
+		t.Fatal(err)
+	}
+	if initial := readMessage(t, conn); initial.Event != "stats:proportion:total" {
+		t.Fatalf("initial data %s, want stats:proportion:total", initial.Event)
+	}
+	return conn, available.Seq
+}
+
+// broadcastNotices broadcasts count notices, returning once the observer has
+// received them, with the sequence number of the last
+func broadcastNotices(t *testing.T, hub *Hub, observer *websocket.Conn, count int) (seq uint64) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		message, err := json.Marshal(Message{Event: "notice", Payload: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hub.broadcast(message)
+	}
+	for i := 0; i < count; i++ {
+		seq = readMessage(t, observer).Seq
+	}
+	return seq
+}
+
+func TestResumeReplaysMissedMessages(t *testing.T) {
+	server := resumeServer(t, 4)
+	hub := server.Hubs["election"]
+	observer, _ := connectReady(t, server)
+	client, _ := connectReady(t, server)
+
+	last := broadcastNotices(t, hub, observer, 1)
+	if message := readMessage(t, client); message.Seq != last {
+		t.Fatalf("client received seq %d, want %d", message.Seq, last)
+	}
+	client.Close()
+	broadcastNotices(t, hub, observer, 2)
+
+	// The messages missed are held, so are sent in place of the initial data
+	resumed := dialResume(t, server, last)
+	for i := uint64(1); i <= 2; i++ {
+		message := readMessage(t, resumed)
+		if message.Event != "notice" || message.Seq != last+i {
+			t.Fatalf("resumed with %s seq %d, want notice seq %d", message.Event, message.Seq, last+i)
+		}
+	}
+	broadcastNotices(t, hub, observer, 1)
+	if message := readMessage(t, resumed); message.Event != "notice" || message.Seq != last+3 {
+		t.Fatalf("resumed client then received %s seq %d, want notice seq %d", message.Event, message.Seq, last+3)
+	}
+}
+
+func TestResumePastReplayBufferResyncs(t *testing.T) {
+	server := resumeServer(t, 4)
+	hub := server.Hubs["election"]
+	observer, _ := connectReady(t, server)
+	client, _ := connectReady(t, server)
+
+	last := broadcastNotices(t, hub, observer, 1)
+	readMessage(t, client)
+	client.Close()
+	latest := broadcastNotices(t, hub, observer, 6)
+
+	// More messages were missed than are held, so the client starts over
+	resumed := dialResume(t, server, last)
+	available := readMessage(t, resumed)
+	if available.Event != "available" || available.Seq != latest {
+		t.Fatalf("resumed with %s seq %d, want available seq %d", available.Event, available.Seq, latest)
+	}
+	if err := resumed.WriteJSON(Message{Version: ProtocolVersion, Event: "ready"}); err != nil {
+		t.Fatal(err)
+	}
+	if initial := readMessage(t, resumed); initial.Event != "stats:proportion:total" {
+		t.Fatalf("resynced with %s, want stats:proportion:total", initial.Event)
+	}
+}
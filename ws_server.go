@@ -6,118 +6,374 @@ package arithmospora
  */
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 )
 
+// WebsocketConfig sets the hub's timings, in seconds, and the number of
+// shards across which its clients are spread. Shards defaults to the number
+// of CPUs. SlowClientPolicy chooses how messages are held for clients whose
+// send buffer is full, defaulting to SlowClientDisconnect, and
+// SlowClientGrace how many seconds such a client may stay behind before it
+// is disconnected, or zero for no limit under the other policies.
+// ReplayBuffer is the number of broadcast messages held for resuming
+// clients, defaulting to defaultReplayBuffer, and ReadyTimeoutMs how long to
+// wait for a new client's ready message before sending the initial data
+// anyway, defaulting to defaultReadyTimeoutMs
 type WebsocketConfig struct {
-	WriteWait  int
-	PongWait   int
-	PingPeriod int
+	WriteWait        int
+	PongWait         int
+	PingPeriod       int
+	Shards           int
+	SlowClientPolicy string
+	SlowClientGrace  int
+	ReplayBuffer     int
+	ReadyTimeoutMs   int
 }
 
-var websocketConfig = WebsocketConfig{WriteWait: 10, PongWait: 60, PingPeriod: 54}
+// defaultWebsocketConfig is used in place of an empty websocket section
+var defaultWebsocketConfig = WebsocketConfig{WriteWait: 10, PongWait: 60, PingPeriod: 54}
 
-func SetWebSocketConfig(config WebsocketConfig) {
-	if config != (WebsocketConfig{}) {
-		websocketConfig = config
-	}
+// Each shard buffers a few broadcasts so one busy shard does not hold up the
+// hub's fan-out to the others
+const hubShardBacklog = 16
+
+// Hub: as per Gorilla chat example, but with clients spread across shards,
+// each serving its clients from its own goroutine so that registrations and
+// fan-out to large audiences proceed in parallel. Broadcasts reach every
+// shard in the order sent, numbered in sequence and held for resuming
+// clients
+type Hub struct {
+	clientCount   int64 // first for 64-bit alignment of atomic access
+	seq           uint64
+	Broadcast     chan []byte
+	replay        *replayBuffer
+	shards        []*hubShard
+	next          uint32
+	done          chan struct{}
+	source        *Source
+	config        WebsocketConfig
+	upgrader      websocket.Upgrader
+	disconnectsMu sync.Mutex
+	disconnects   map[string]int
+	tapsMu        sync.Mutex
+	taps          map[*hubTap]bool
 }
 
-// Websocket upgrader: output only application, allow connections from any origin
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+// hubTap receives a copy of every message broadcast by a hub
+type hubTap struct {
+	messages  chan []byte
+	closeOnce sync.Once
 }
 
-// Hub: as per Gorilla chat example
-type Hub struct {
-	Broadcast  chan []byte
+func (ht *hubTap) close() {
+	ht.closeOnce.Do(func() { close(ht.messages) })
+}
+
+// hubShard serves a share of a hub's clients
+type hubShard struct {
+	hub        *Hub
 	clients    map[*Client]bool
+	backlogged map[*Client]bool
 	register   chan *Client
 	unregister chan *Client
-	source     *Source
+	ready      chan clientReady
+	broadcast  chan hubBroadcast
+	prepared   chan preparedMessage
+	lastSeq    uint64
 }
 
-func NewHub(source *Source) *Hub {
-	return &Hub{
-		Broadcast:  make(chan []byte),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
-		source:     source,
+// NewHub returns a hub serving the source to websocket clients with the given
+// timings, or the default timings if none are set
+func NewHub(source *Source, config WebsocketConfig) *Hub {
+	if config.WriteWait == 0 && config.PongWait == 0 && config.PingPeriod == 0 {
+		config.WriteWait = defaultWebsocketConfig.WriteWait
+		config.PongWait = defaultWebsocketConfig.PongWait
+		config.PingPeriod = defaultWebsocketConfig.PingPeriod
+	}
+	if config.Shards <= 0 {
+		config.Shards = runtime.NumCPU()
+	}
+	if config.SlowClientPolicy == "" {
+		config.SlowClientPolicy = SlowClientDisconnect
 	}
+	if config.ReplayBuffer <= 0 {
+		config.ReplayBuffer = defaultReplayBuffer
+	}
+	if config.ReadyTimeoutMs <= 0 {
+		config.ReadyTimeoutMs = defaultReadyTimeoutMs
+	}
+	hub := &Hub{
+		seq:         firstSeq(),
+		Broadcast:   make(chan []byte),
+		replay:      newReplayBuffer(config.ReplayBuffer),
+		done:        make(chan struct{}),
+		source:      source,
+		config:      config,
+		disconnects: make(map[string]int),
+		taps:        make(map[*hubTap]bool),
+		// Websocket upgrader: output only application, allow connections
+		// from any origin
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+	for i := 0; i < config.Shards; i++ {
+		hub.shards = append(hub.shards, &hubShard{
+			hub:        hub,
+			clients:    make(map[*Client]bool),
+			backlogged: make(map[*Client]bool),
+			register:   make(chan *Client),
+			unregister: make(chan *Client),
+			ready:      make(chan clientReady),
+			broadcast:  make(chan hubBroadcast, hubShardBacklog),
+			prepared:   make(chan preparedMessage),
+			lastSeq:    hub.seq,
+		})
+	}
+	return hub
 }
 
-func (h *Hub) Run() {
+// Run serves clients until ctx is done, when all clients are disconnected
+func (h *Hub) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer close(h.done)
+	defer h.closeTaps()
+	defer wg.Wait()
+	for _, shard := range h.shards {
+		wg.Add(1)
+		go func(shard *hubShard) {
+			defer wg.Done()
+			shard.run(ctx)
+		}(shard)
+	}
+
 	for {
 		select {
-		case client := <-h.register:
-			h.clients[client] = true
-
-			// Source sends client initial data on connect
-			h.source.SendInitialDataTo(client)
-		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.closed)
-				close(client.send)
-			}
-		case message := <-h.Broadcast:
-			for client := range h.clients {
+		case <-ctx.Done():
+			return
+		case data := <-h.Broadcast:
+			h.seq++
+			message := hubBroadcast{seq: h.seq, data: stampSeq(data, h.seq)}
+			h.replay.add(message)
+			for _, shard := range h.shards {
 				select {
-				case client.send <- message:
-				default:
-					close(client.closed)
-					close(client.send)
-					delete(h.clients, client)
+				case shard.broadcast <- message:
+				case <-ctx.Done():
+					return
 				}
 			}
+			h.sendToTaps(message.data)
+		}
+	}
+}
+
+// Each tap buffers this many messages, beyond which it is closed
+const hubTapBacklog = 1024
+
+// Tap returns a channel receiving every message the hub broadcasts, from now
+// until ctx is done. The channel is closed then, once the hub stops, or if
+// its receiver falls too far behind, when messages may have been missed
+func (h *Hub) Tap(ctx context.Context) <-chan []byte {
+	tap := &hubTap{messages: make(chan []byte, hubTapBacklog)}
+	h.tapsMu.Lock()
+	select {
+	case <-h.done:
+		tap.close()
+	default:
+		h.taps[tap] = true
+	}
+	h.tapsMu.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-h.done:
+		}
+		h.tapsMu.Lock()
+		delete(h.taps, tap)
+		h.tapsMu.Unlock()
+		tap.close()
+	}()
+	return tap.messages
+}
+
+func (h *Hub) sendToTaps(message []byte) {
+	h.tapsMu.Lock()
+	defer h.tapsMu.Unlock()
+	for tap := range h.taps {
+		select {
+		case tap.messages <- message:
+		default:
+			delete(h.taps, tap)
+			tap.close()
+		}
+	}
+}
+
+func (h *Hub) closeTaps() {
+	h.tapsMu.Lock()
+	defer h.tapsMu.Unlock()
+	for tap := range h.taps {
+		delete(h.taps, tap)
+		tap.close()
+	}
+}
+
+func (hs *hubShard) run(ctx context.Context) {
+	ticker := time.NewTicker(backlogFlushInterval)
+	defer ticker.Stop()
+	for {
+		// Retry sending held messages only while clients are behind
+		var flushTicks <-chan time.Time
+		if len(hs.backlogged) > 0 {
+			flushTicks = ticker.C
+		}
+
+		select {
+		case <-ctx.Done():
+			for client := range hs.clients {
+				hs.remove(client, DisconnectShutdown)
+			}
+			return
+		case client := <-hs.register:
+			hs.clients[client] = true
+			atomic.AddInt64(&hs.hub.clientCount, 1)
+
+			// Client is sent the available stats on connect, then the
+			// initial data once ready, unless it is resuming and can be
+			// sent just what it missed
+			if hs.resume(client) {
+				client.ready = true
+			} else {
+				hs.awaitReady(client, hs.lastSeq)
+			}
+		case ready := <-hs.ready:
+			hs.handleReady(ready)
+		case client := <-hs.unregister:
+			if _, ok := hs.clients[client]; ok {
+				hs.remove(client, DisconnectClosed)
+			}
+		case broadcast := <-hs.broadcast:
+			hs.lastSeq = broadcast.seq
+			message := &broadcastMessage{seq: broadcast.seq, data: broadcast.data}
+			for client := range hs.clients {
+				hs.deliver(client, message)
+			}
+		case prepared := <-hs.prepared:
+			hs.handlePrepared(prepared)
+		case <-flushTicks:
+			for client := range hs.backlogged {
+				hs.flush(client)
+			}
 		}
 	}
 }
 
+// remove disconnects a registered client for the given reason
+func (hs *hubShard) remove(client *Client, reason string) {
+	delete(hs.clients, client)
+	delete(hs.backlogged, client)
+	atomic.AddInt64(&hs.hub.clientCount, -1)
+	if client.readyTimer != nil {
+		client.readyTimer.Stop()
+	}
+	hs.hub.disconnectsMu.Lock()
+	hs.hub.disconnects[reason]++
+	hs.hub.disconnectsMu.Unlock()
+	client.reason = reason
+	close(client.closed)
+	close(client.send)
+}
+
+// shard chooses the shard for a new client, spreading clients evenly
+func (h *Hub) shard() *hubShard {
+	return h.shards[int(atomic.AddUint32(&h.next, 1)%uint32(len(h.shards)))]
+}
+
+// broadcast sends message to all clients, returning false without sending if
+// the hub has stopped
+func (h *Hub) broadcast(message []byte) bool {
+	select {
+	case h.Broadcast <- message:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// ClientCount returns the number of clients connected across all shards
 func (h *Hub) ClientCount() int {
-	return len(h.clients)
+	return int(atomic.LoadInt64(&h.clientCount))
+}
+
+// PopDisconnectCounts returns the number of clients disconnected for each
+// reason since last called
+func (h *Hub) PopDisconnectCounts() (poppedCounts map[string]int) {
+	h.disconnectsMu.Lock()
+	poppedCounts = h.disconnects
+	h.disconnects = make(map[string]int)
+	h.disconnectsMu.Unlock()
+	return poppedCounts
 }
 
 type Client struct {
-	hub    *Hub
-	conn   *websocket.Conn
-	send   chan []byte
-	closed chan struct{}
-	errors chan<- error
+	hub           *Hub
+	shard         *hubShard
+	conn          *websocket.Conn
+	send          chan []byte
+	closed        chan struct{}
+	errors        chan<- error
+	backlog       *clientBacklog
+	reason        string
+	since         uint64
+	ready         bool
+	readyTimer    *time.Timer
+	version       int
+	subscriptions map[string]bool
 }
 
-// Readpump handles client Pong messages and loops to disregard client messages
-// TODO: Implement capability for clients to send messages to opt in or out of
-// particular stats
+// Readpump handles client Pong messages and reads client messages, passing
+// ready messages to the client's shard
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.unregister <- c
+		select {
+		case c.shard.unregister <- c:
+		case <-c.hub.done:
+		}
 		c.conn.Close()
 	}()
-	c.conn.SetReadDeadline(time.Now().Add(time.Duration(websocketConfig.PongWait) * time.Second))
+	c.conn.SetReadLimit(maxClientMessage)
+	c.conn.SetReadDeadline(time.Now().Add(time.Duration(c.hub.config.PongWait) * time.Second))
 	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(time.Duration(websocketConfig.PongWait) * time.Second))
+		c.conn.SetReadDeadline(time.Now().Add(time.Duration(c.hub.config.PongWait) * time.Second))
 		return nil
 	})
 	for {
-		_, _, err := c.conn.NextReader()
+		_, message, err := c.conn.ReadMessage()
 		if err != nil {
 			c.conn.Close()
 			break
 		}
+		if !c.readMessage(message) {
+			break
+		}
 	}
 }
 
 // Only write one message at a time with writePump rather than aggregating as
 // per the chat example, as our messages are JSON documents
 func (c *Client) writePump() {
-	ticker := time.NewTicker(time.Duration(websocketConfig.PingPeriod) * time.Second)
+	ticker := time.NewTicker(time.Duration(c.hub.config.PingPeriod) * time.Second)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
@@ -128,17 +384,18 @@ func (c *Client) writePump() {
 			if !utf8.Valid(message) {
 				c.errors <- fmt.Errorf("Invalid UTF8 byte sequence in message: %s", message)
 			}
-			c.conn.SetWriteDeadline(time.Now().Add(time.Duration(websocketConfig.WriteWait) * time.Second))
+			c.conn.SetWriteDeadline(time.Now().Add(time.Duration(c.hub.config.WriteWait) * time.Second))
 			if !ok {
-				// Hub closed channel
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				// Hub closed channel: tell the client why
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode(c.reason), c.reason))
+				return
 			}
 
 			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
 				return
 			}
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(time.Duration(websocketConfig.WriteWait) * time.Second))
+			c.conn.SetWriteDeadline(time.Now().Add(time.Duration(c.hub.config.WriteWait) * time.Second))
 			if err := c.conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
 				return
 			}
@@ -148,17 +405,31 @@ func (c *Client) writePump() {
 
 // ServeWs handles websocket requests from the peer.
 func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request, errors chan<- error) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := hub.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return
 	}
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), closed: make(chan struct{}), errors: errors}
-	client.hub.register <- client
+	client := &Client{hub: hub, shard: hub.shard(), conn: conn, send: make(chan []byte, clientSendBuffer), closed: make(chan struct{}), errors: errors}
+	// A reconnecting client gives the sequence number of the last message
+	// it received
+	client.since, _ = strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+	select {
+	case client.shard.register <- client:
+	case <-hub.done:
+		conn.Close()
+		return
+	}
 	go client.writePump()
 	client.readPump()
 }
 
+// Message is sent to clients as JSON. Seq is the sequence number of a
+// broadcast message, set as it is broadcast, or of the last message
+// broadcast before an available message. Version is the protocol version
+// spoken by the sender, given in available and ready messages
 type Message struct {
+	Seq     uint64      `json:"seq,omitempty"`
+	Version int         `json:"version,omitempty"`
 	Event   string      `json:"event"`
 	Payload interface{} `json:"payload"`
 }